@@ -4,40 +4,79 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func (dd *DarknetD) startAPI(addr string) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: dd.router(),
+	}
+	return srv.ListenAndServe()
+}
+
+func (dd *DarknetD) router() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/", httpRootHandler).Methods("GET")
 	r.HandleFunc("/objects", dd.httpObjectsHandler).Methods("GET")
 	r.HandleFunc("/latest.jpg", dd.httpLatestHandler).Methods("GET")
 	r.HandleFunc("/image/{imgname}", dd.httpImageHandler).Methods("GET")
+	r.HandleFunc("/detect", dd.httpDetectHandler).Methods("POST")
+	r.HandleFunc("/detections", dd.httpDetectionsHandler).Methods("GET")
+	r.HandleFunc("/tracks", dd.httpTracksHandler).Methods("GET")
+	r.HandleFunc("/counters", dd.httpCountersHandler).Methods("GET")
+	r.HandleFunc("/events", dd.httpEventsHandler).Methods("GET")
+	r.HandleFunc("/ws", dd.httpWebsocketHandler).Methods("GET")
+	r.HandleFunc("/cameras", dd.httpCamerasHandler).Methods("GET")
+	r.HandleFunc("/cameras/{camera}/objects", dd.httpObjectsHandler).Methods("GET")
+	r.HandleFunc("/cameras/{camera}/latest.jpg", dd.httpLatestHandler).Methods("GET")
+	r.HandleFunc("/cameras/{camera}/image/{imgname}", dd.httpImageHandler).Methods("GET")
+	r.HandleFunc("/cameras/{camera}/tracks", dd.httpTracksHandler).Methods("GET")
+	r.HandleFunc("/cameras/{camera}/counters", dd.httpCountersHandler).Methods("GET")
+	r.HandleFunc("/ingest/{camera}", dd.httpIngestHandler).Methods("PUT")
+	r.HandleFunc("/status", dd.httpStatusHandler).Methods("GET")
+	r.HandleFunc("/health", dd.httpHealthHandler)
+	r.HandleFunc("/admin/reload", dd.httpReloadHandler).Methods("POST")
+	r.HandleFunc("/admin/model", dd.httpModelHandler).Methods("GET")
+	r.HandleFunc("/admin/models", dd.httpModelsHandler).Methods("GET")
+	r.HandleFunc("/admin/model", dd.httpSwitchModelHandler).Methods("PUT")
 
 	registerMetricsHandlers(r)
-	srv := &http.Server{
-		Addr:    addr,
-		Handler: r,
-	}
-	return srv.ListenAndServe()
+	return r
 }
 
 const rootHtml = `<html><body>
 <h1>darknetd API</h1>
 <ul>
-<li> <a href="objects">/objects</a>: returns JSON list of most recent predictions
-<li> <a href="latest.jpg">/latest.jpg</a>: returns latest source image
-<li> /image/{imagename}.jpg: returns source or prediction image (get {imagename} from /objects output)
+<li> <a href="objects">/objects</a>?camera=&amp;class=&amp;zone=&amp;minprob=&amp;since=&amp;limit=&amp;nonempty=&amp;after=: returns JSON list of most recent predictions
+<li> <a href="latest.jpg">/latest.jpg</a>: returns latest source image of the first camera
+<li> /image/{imagename}.jpg: returns source or prediction image of the first camera (get {imagename} from /objects output)
+<li> <a href="cameras">/cameras</a>: returns JSON list of cameras and their latest predictions
+<li> /cameras/{camera}/objects, /latest.jpg, /image/{imagename}.jpg, /tracks, /counters: as above, for one camera
+<li> <a href="detections">/detections</a>?camera=&amp;from=&amp;to=&amp;class=&amp;minprob=: returns JSON detection history, default last 24 hours
+<li> <a href="tracks">/tracks</a>: returns JSON list of objects currently being tracked by the first camera
+<li> <a href="counters">/counters</a>: returns JSON line crossing counts of the first camera
+<li> <a href="events">/events</a>?camera=&amp;class=&amp;minprob=&amp;nonempty=: streams new predictions as Server-Sent Events
+<li> /ws?camera=&amp;class=&amp;minprob=&amp;nonempty=: streams new predictions as WebSocket JSON messages
+<li> POST /detect: runs detection on an uploaded JPEG or PNG and returns the JSON result (add ?pred=true to include the prediction image)
+<li> PUT /ingest/{camera}: stores a JPEG pushed by a remote capture client in the camera's archive and queues it for detection
+<li> <a href="status">/status</a>: returns JSON darknet process status and restart count
 <li> <a href="metrics">/metrics</a>: returns performance metrics in prometheus format
-<li> <a href="health">/health</a>: returns 'OK' if healthy
+<li> <a href="health">/health</a>: returns 'OK' if darknet is running, and the health of camera URLs
+<li> POST /admin/reload: reloads the config, returning JSON with what needs a restart
+<li> <a href="admin/model">/admin/model</a>?name=: returns JSON of the active model; PUT a model to switch to it without downtime
+<li> <a href="admin/models">/admin/models</a>: returns JSON list of the active models
 </ul>
 </body></html>`
 
@@ -45,8 +84,100 @@ func httpRootHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, rootHtml)
 }
 
+// requestCamera returns the camera named by the {camera} route variable or,
+// on un-namespaced routes, def. Unknown cameras get a 404.
+func (dd *DarknetD) requestCamera(w http.ResponseWriter, r *http.Request, handler string, def *Camera) (*Camera, bool) {
+	name, ok := mux.Vars(r)["camera"]
+	if !ok {
+		return def, true
+	}
+	cam := dd.camera(name)
+	if cam == nil {
+		e := fmt.Errorf("Unknown camera: %s", name)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusNotFound)
+		dd.metrics.ApiErrors.WithLabelValues(handler, "UnknownCamera").Add(1)
+		return nil, false
+	}
+	return cam, true
+}
+
+func (dd *DarknetD) httpCamerasHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := json.Marshal(dd.cameraStatus())
+	if err != nil {
+		e := fmt.Errorf("Result processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/cameras", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/cameras").Add(1)
+}
+
 func (dd *DarknetD) httpObjectsHandler(w http.ResponseWriter, r *http.Request) {
-	out, err := json.Marshal(dd.detections.Values())
+	cam, ok := dd.requestCamera(w, r, "/objects", nil)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	filter, err := parseResultFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/objects", "BadParam").Add(1)
+		return
+	}
+	since, err := parseTimeParam(q, "since", time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/objects", "BadParam").Add(1)
+		return
+	}
+	maxResults := cameraRecentResults
+	if cam == nil {
+		maxResults *= len(dd.cameras)
+	}
+	limit, err := parseLimitParam(q, maxResults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/objects", "BadParam").Add(1)
+		return
+	}
+	var after uint64
+	if v := q.Get("after"); v != "" {
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid after: %s", v), http.StatusBadRequest)
+			dd.metrics.ApiErrors.WithLabelValues("/objects", "BadParam").Add(1)
+			return
+		}
+	}
+
+	results := []DarknetResult{}
+	cursor := after
+	for _, lr := range dd.recentDetections(cam) {
+		if lr.ID > cursor {
+			cursor = lr.ID
+		}
+		if lr.ID <= after || lr.PredTime.Before(since) {
+			continue
+		}
+		lr, ok := filter.apply(lr)
+		if !ok {
+			continue
+		}
+		results = append(results, lr)
+	}
+	if len(results) > limit {
+		if after > 0 {
+			// page forward from the cursor, oldest first
+			results = results[:limit]
+			cursor = results[limit-1].ID
+		} else {
+			results = results[len(results)-limit:]
+		}
+	}
+
+	out, err := json.Marshal(results)
 	if err != nil {
 		e := fmt.Errorf("Result processing error: %s", err)
 		fmt.Println(e)
@@ -54,12 +185,384 @@ func (dd *DarknetD) httpObjectsHandler(w http.ResponseWriter, r *http.Request) {
 		dd.metrics.ApiErrors.WithLabelValues("/objects", "json.Marshal").Add(1)
 		return
 	}
+	w.Header().Set("X-Cursor", strconv.FormatUint(cursor, 10))
 	fmt.Fprintln(w, string(out))
 	dd.metrics.ApiRequests.WithLabelValues("/objects").Add(1)
 }
 
+func (dd *DarknetD) httpDetectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if dd.history == nil {
+		e := fmt.Errorf("Detection history is disabled")
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusNotFound)
+		dd.metrics.ApiErrors.WithLabelValues("/detections", "Disabled").Add(1)
+		return
+	}
+	q := r.URL.Query()
+	filter, err := parseResultFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/detections", "BadParam").Add(1)
+		return
+	}
+	to, err := parseTimeParam(q, "to", time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/detections", "BadParam").Add(1)
+		return
+	}
+	from, err := parseTimeParam(q, "from", to.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/detections", "BadParam").Add(1)
+		return
+	}
+	limit, err := parseLimitParam(q, historyMaxResults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/detections", "BadParam").Add(1)
+		return
+	}
+
+	results, err := dd.history.Query(from, to, filter, limit)
+	if err != nil {
+		e := fmt.Errorf("History query error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/detections", "Query").Add(1)
+		return
+	}
+	out, err := json.Marshal(results)
+	if err != nil {
+		e := fmt.Errorf("Result processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/detections", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/detections").Add(1)
+}
+
+func (dd *DarknetD) httpTracksHandler(w http.ResponseWriter, r *http.Request) {
+	cam, ok := dd.requestCamera(w, r, "/tracks", dd.cameras[0])
+	if !ok {
+		return
+	}
+	if !cam.tracker.enabled() {
+		e := fmt.Errorf("Tracking is disabled")
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusNotFound)
+		dd.metrics.ApiErrors.WithLabelValues("/tracks", "Disabled").Add(1)
+		return
+	}
+	out, err := json.Marshal(cam.tracker.Tracks())
+	if err != nil {
+		e := fmt.Errorf("Result processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/tracks", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/tracks").Add(1)
+}
+
+func (dd *DarknetD) httpCountersHandler(w http.ResponseWriter, r *http.Request) {
+	cam, ok := dd.requestCamera(w, r, "/counters", dd.cameras[0])
+	if !ok {
+		return
+	}
+	if !cam.lines.enabled() {
+		e := fmt.Errorf("No lines configured")
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusNotFound)
+		dd.metrics.ApiErrors.WithLabelValues("/counters", "Disabled").Add(1)
+		return
+	}
+	out, err := json.Marshal(cam.lines.Counts())
+	if err != nil {
+		e := fmt.Errorf("Result processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/counters", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/counters").Add(1)
+}
+
+// DetectResponse is returned by /detect. PredImageData holds the annotated
+// prediction JPEG, base64 encoded, when requested with ?pred=true.
+type DetectResponse struct {
+	DarknetResult
+	PredImageData []byte `json:",omitempty"`
+}
+
+func (dd *DarknetD) httpDetectHandler(w http.ResponseWriter, r *http.Request) {
+	wantPred := false
+	if v := r.URL.Query().Get("pred"); v != "" {
+		var err error
+		wantPred, err = strconv.ParseBool(v)
+		if err != nil {
+			e := fmt.Errorf("Invalid pred parameter: %s", v)
+			fmt.Println(e)
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			dd.metrics.ApiErrors.WithLabelValues("/detect", "BadParam").Add(1)
+			return
+		}
+	}
+	name, img, err := readUpload(w, r)
+	if err != nil {
+		e := fmt.Errorf("Error reading upload: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/detect", "Upload").Add(1)
+		return
+	}
+	ext, ok := uploadTypes[http.DetectContentType(img)]
+	if !ok {
+		e := fmt.Errorf("Unsupported image type: %s", http.DetectContentType(img))
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusUnsupportedMediaType)
+		dd.metrics.ApiErrors.WithLabelValues("/detect", "ImageType").Add(1)
+		return
+	}
+
+	capDir := dd.cameras[0].CaptureDir
+	f, err := ioutil.TempFile(capDir, "upload-*"+ext)
+	if err != nil {
+		e := fmt.Errorf("Error storing upload: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/detect", "TempFile").Add(1)
+		return
+	}
+	imgPath := f.Name()
+	predPath := filepath.Join(capDir, "predictions_"+filepath.Base(imgPath))
+	defer os.Remove(imgPath)
+	defer os.Remove(predPath)
+	_, err = f.Write(img)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		e := fmt.Errorf("Error storing upload: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/detect", "WriteFile").Add(1)
+		return
+	}
+
+	imgTime := time.Now()
+	lr, err := dd.detectUpload(imgPath, predPath)
+	if err != nil {
+		e := fmt.Errorf("Detection error: %s", err)
+		fmt.Println(e)
+		status := http.StatusInternalServerError
+		if err == errDarknetNotRunning {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, e.Error(), status)
+		dd.metrics.ApiErrors.WithLabelValues("/detect", "Detect").Add(1)
+		return
+	}
+	lr.Image = name
+	lr.ImageTime = imgTime
+	resp := DetectResponse{DarknetResult: lr}
+	if wantPred {
+		resp.PredImageData, err = ioutil.ReadFile(predPath)
+		if err != nil {
+			e := fmt.Errorf("Error reading prediction image: %s", err)
+			fmt.Println(e)
+			http.Error(w, e.Error(), http.StatusInternalServerError)
+			dd.metrics.ApiErrors.WithLabelValues("/detect", "PredImage").Add(1)
+			return
+		}
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		e := fmt.Errorf("Result processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/detect", "json.Marshal").Add(1)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/detect").Add(1)
+}
+
+// uploadTypes maps accepted upload content types to file extensions.
+var uploadTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// readUpload returns the image from a multipart "image" field or, for any
+// other content type, the raw request body.
+func readUpload(w http.ResponseWriter, r *http.Request) (string, []byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, hdr, err := r.FormFile("image")
+		if err != nil {
+			return "", nil, err
+		}
+		defer f.Close()
+		img, err := ioutil.ReadAll(f)
+		return hdr.Filename, img, err
+	}
+	img, err := ioutil.ReadAll(r.Body)
+	return "upload", img, err
+}
+
+func (dd *DarknetD) httpStatusHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := json.Marshal(dd.getState())
+	if err != nil {
+		e := fmt.Errorf("Status processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/status", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/status").Add(1)
+}
+
+func (dd *DarknetD) httpReloadHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := dd.reload()
+	if err != nil {
+		e := fmt.Errorf("Config error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/reload", "reload").Add(1)
+		return
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		e := fmt.Errorf("Reload processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/reload", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/admin/reload").Add(1)
+}
+
+func (dd *DarknetD) httpModelsHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := json.Marshal(dd.currentConfig().models)
+	if err != nil {
+		e := fmt.Errorf("Model processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/models", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/admin/models").Add(1)
+}
+
+// httpModelHandler returns the model named by the name query parameter, by
+// default the first one.
+func (dd *DarknetD) httpModelHandler(w http.ResponseWriter, r *http.Request) {
+	models := dd.currentConfig().models
+	model := models[0]
+	if name := r.URL.Query().Get("name"); name != "" {
+		found := false
+		for _, m := range models {
+			if m.Name == name {
+				model, found = m, true
+			}
+		}
+		if !found {
+			e := fmt.Errorf("No model named %s", name)
+			fmt.Println(e)
+			http.Error(w, e.Error(), http.StatusNotFound)
+			dd.metrics.ApiErrors.WithLabelValues("/admin/model", "NotFound").Add(1)
+			return
+		}
+	}
+	out, err := json.Marshal(model)
+	if err != nil {
+		e := fmt.Errorf("Model processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/model", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/admin/model").Add(1)
+}
+
+// httpSwitchModelHandler switches to the Model in the request body, replying
+// once detections run on it.
+func (dd *DarknetD) httpSwitchModelHandler(w http.ResponseWriter, r *http.Request) {
+	model := Model{}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	if err := json.NewDecoder(r.Body).Decode(&model); err != nil {
+		e := fmt.Errorf("Invalid model: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/model", "json.Decode").Add(1)
+		return
+	}
+	if err := validateModel(&model, dd.currentConfig()); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/model", "validateModel").Add(1)
+		return
+	}
+	if !dd.switchmtx.TryLock() {
+		e := fmt.Errorf("A model switch is already in progress")
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusConflict)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/model", "InProgress").Add(1)
+		return
+	}
+	defer dd.switchmtx.Unlock()
+	if err := dd.switchModel(model); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/model", "switchModel").Add(1)
+		return
+	}
+	out, err := json.Marshal(model)
+	if err != nil {
+		e := fmt.Errorf("Model processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/admin/model", "json.Marshal").Add(1)
+		return
+	}
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/admin/model").Add(1)
+}
+
+// httpHealthHandler reports whether darknet is running, followed by the
+// health of each camera URL. A camera that is down doesn't fail the check:
+// restarting darknetd wouldn't bring it back.
+func (dd *DarknetD) httpHealthHandler(w http.ResponseWriter, r *http.Request) {
+	state := dd.getState()
+	if state.status != DARKNET_RUNNING {
+		http.Error(w, fmt.Sprintf("darknet %s", state.Status), http.StatusServiceUnavailable)
+	} else {
+		fmt.Fprintln(w, "OK")
+	}
+	for _, cam := range dd.cameras {
+		if cam.source != nil {
+			fmt.Fprintf(w, "camera %s: %s\n", cam.Name, cam.source.getHealth())
+		}
+	}
+}
+
 func (dd *DarknetD) httpImageHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Handling image request")
+	cam, ok := dd.requestCamera(w, r, "/image/", dd.cameras[0])
+	if !ok {
+		return
+	}
 	vars := mux.Vars(r)
 	imgName, exist := vars["imgname"]
 	if !exist {
@@ -76,7 +579,7 @@ func (dd *DarknetD) httpImageHandler(w http.ResponseWriter, r *http.Request) {
 		dd.metrics.ApiErrors.WithLabelValues("/image/", "NotJPG").Add(1)
 		return
 	}
-	imgFile := filepath.Join(dd.config.archiveDir, imgName)
+	imgFile := filepath.Join(cam.ArchiveDir, imgName)
 	f, err := os.Open(imgFile)
 	if err != nil {
 		e := fmt.Errorf("Error accessing image at %s: %s", imgFile, err)
@@ -100,7 +603,11 @@ func (dd *DarknetD) httpImageHandler(w http.ResponseWriter, r *http.Request) {
 
 func (dd *DarknetD) httpLatestHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Handling latest image request")
-	imgFile := filepath.Join(dd.config.capDir, dd.config.capFile)
+	cam, ok := dd.requestCamera(w, r, "/latest.jpg", dd.cameras[0])
+	if !ok {
+		return
+	}
+	imgFile := filepath.Join(cam.CaptureDir, cam.CaptureFile)
 	f, err := os.Open(imgFile)
 	if err != nil {
 		e := fmt.Errorf("Error accessing latest image at %s: %s", imgFile, err)
@@ -123,9 +630,6 @@ func (dd *DarknetD) httpLatestHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func registerMetricsHandlers(r *mux.Router) {
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "OK")
-	})
 	r.Handle("/metrics", promhttp.Handler())
 	r.HandleFunc("/debug/pprof/", pprof.Index)
 	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestObjectsFilters(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	td := startTestDaemon(t, newTestDir(t))
+	td.capture("image1.jpg")
+	td.waitForImage("/objects", "image1.jpg")
+	td.capture("image2.jpg")
+	td.waitForImage("/objects", "image2.jpg")
+
+	if results := td.objects("?limit=1"); len(results) != 1 || results[0].Image != "image2.jpg" {
+		t.Errorf("limit=1 returned %+v", results)
+	}
+	results := td.objects("?class=dog&nonempty=true")
+	if len(results) != 1 || len(results[0].Objects) != 1 || results[0].Objects[0].Class != "dog" {
+		t.Errorf("class=dog returned %+v", results)
+	}
+	if results := td.objects("?minprob=80"); len(results) != 1 || results[0].Image != "image1.jpg" {
+		t.Errorf("minprob=80 returned %+v", results)
+	}
+	if results := td.objects("?since=2100-01-01T00:00:00Z"); len(results) != 0 {
+		t.Errorf("since returned %+v", results)
+	}
+	for _, query := range []string{"?limit=x", "?since=yesterday", "?after=-1", "?minprob=high"} {
+		if status, _ := td.get("/objects" + query); status != http.StatusBadRequest {
+			t.Errorf("/objects%s: %d", query, status)
+		}
+	}
+
+	resp, err := http.Get(td.server.URL + "/objects?limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cursor := resp.Header.Get("X-Cursor")
+	if _, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+		t.Fatalf("Bad X-Cursor %q", cursor)
+	}
+	if results := td.objects("?after=" + cursor); len(results) != 0 {
+		t.Errorf("after=X-Cursor returned %+v", results)
+	}
+	td.capture("image3.jpg")
+	td.waitForImage("/objects", "image3.jpg")
+	if results := td.objects("?after=" + cursor); len(results) != 1 || results[0].Image != "image3.jpg" {
+		t.Errorf("after=X-Cursor returned %+v", results)
+	}
+}
+
+func TestImages(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t))
+	writeFile(t, td.dir+"/cap/cap.jpg", "latest")
+	td.capture("image1.jpg")
+	td.waitForImage("/objects", "image1.jpg")
+
+	for path, want := range map[string]string{
+		"/latest.jpg":                       "latest",
+		"/image/image1.jpg":                 fakeJPEG("image1.jpg"),
+		"/image/predictions_image1.jpg":     fakeJPEG("image1.jpg"),
+		"/cameras/default/image/image1.jpg": fakeJPEG("image1.jpg"),
+	} {
+		if status, body := td.get(path); status != http.StatusOK || body != want {
+			t.Errorf("%s: %d %q", path, status, body)
+		}
+	}
+	for _, path := range []string{"/image/missing.jpg", "/image/image1.png", "/cameras/nope/latest.jpg"} {
+		if status, _ := td.get(path); status != http.StatusNotFound {
+			t.Errorf("%s: %d", path, status)
+		}
+	}
+}
+
+func TestDetectUpload(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t))
+	img := fakeJPEG("upload.jpg")
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("image", "upload.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(img))
+	mw.Close()
+	status, out := td.do("POST", "/detect", mw.FormDataContentType(), body.String())
+	resp := DetectResponse{}
+	if err := json.Unmarshal([]byte(out), &resp); status != http.StatusOK || err != nil {
+		t.Fatalf("/detect multipart: %d %s", status, out)
+	}
+	if resp.Image != "upload.jpg" || len(resp.Objects) != 1 || resp.Objects[0].Class != "person" || resp.PredImageData != nil {
+		t.Errorf("/detect multipart returned %+v", resp)
+	}
+
+	status, out = td.do("POST", "/detect?pred=true", "image/jpeg", img)
+	resp = DetectResponse{}
+	if err := json.Unmarshal([]byte(out), &resp); status != http.StatusOK || err != nil {
+		t.Fatalf("/detect raw: %d %s", status, out)
+	}
+	if resp.Image != "upload" || string(resp.PredImageData) != img {
+		t.Errorf("/detect raw returned %+v", resp)
+	}
+
+	if status, _ := td.do("POST", "/detect", "text/plain", "not an image"); status != http.StatusUnsupportedMediaType {
+		t.Errorf("/detect accepted text: %d", status)
+	}
+	if status, _ := td.do("POST", "/detect?pred=maybe", "image/jpeg", img); status != http.StatusBadRequest {
+		t.Errorf("/detect accepted pred=maybe: %d", status)
+	}
+	files, err := ioutil.ReadDir(td.dir + "/cap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		t.Errorf("/detect left %s in the capture dir", f.Name())
+	}
+	if n := td.detections("default", "yolov3-tiny"); n != 0 {
+		t.Errorf("Uploads counted as %d camera detections", n)
+	}
+}
+
+func TestStatusAndHealth(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t))
+	if status, body := td.get("/health"); status != http.StatusOK || body != "OK\n" {
+		t.Errorf("/health: %d %q", status, body)
+	}
+	state := DarknetState{}
+	td.getJSON("/status", &state)
+	if state.Status != "running" || state.Model != "yolov3-tiny" || state.Restarts != 0 {
+		t.Errorf("/status returned %+v", state)
+	}
+	if status, body := td.get("/"); status != http.StatusOK || !strings.Contains(body, "/objects") {
+		t.Errorf("/: %d %q", status, body)
+	}
+
+	td.stop()
+	rec := httptest.NewRecorder()
+	td.httpHealthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "darknet stopped\n" {
+		t.Errorf("/health with darknet stopped: %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zfjagann/golang-ring"
+)
+
+const defaultCamera = "default"
+
+// CameraConfig is a named image source: the capture directory holding its
+// latest image, and the archive directory of images to run detection on.
+// Cameras share the darknet process, taking turns in proportion to Weight.
+// Zones and Lines are given inline or as JSON files, and default to the
+// global zones and lines. Backlog defaults to the --backlog policy. With a
+// URL, darknetd pulls the camera's frames itself every Interval, defaulting
+// to --capture-interval, rather than relying on an external capture tool.
+// MotionMask is an image masking the areas where motion is ignored.
+type CameraConfig struct {
+	Name         string
+	CaptureDir   string
+	CaptureFile  string
+	ArchiveDir   string
+	ArchiveFiles int
+	Weight       int
+	Backlog      string
+	ZonesFile    string
+	LinesFile    string
+	Zones        []Zone
+	Lines        []Line
+	URL          string
+	Interval     string
+	MotionMask   string
+
+	interval   time.Duration
+	motionMask []bool
+}
+
+// Camera holds a source's recent detections and its tracking, zone and line
+// state, which must not mix with other cameras' frames.
+type Camera struct {
+	CameraConfig
+	detections *ring.Ring // guarded by DarknetD.detectionsmtx
+	tracker    *Tracker
+	zones      *Zones
+	lines      *Lines
+	current    int // smooth weighted round-robin, see DarknetD.nextCamera
+
+	watcher *imageWatcher // nil when polling the archive
+	queue   *imageQueue
+	source  *frameSource // nil unless pulling frames from URL
+	motion  *motionGate
+
+	detected  *prometheus.CounterVec // by model
+	ingested  prometheus.Counter
+	jobErrors prometheus.Counter
+	predTime  prometheus.ObserverVec // by model
+	totalTime prometheus.ObserverVec // by model
+}
+
+// CameraStatus is returned by /cameras.
+type CameraStatus struct {
+	Name   string
+	Weight int
+	Source *SourceHealth  `json:",omitempty"`
+	Latest *DarknetResult `json:",omitempty"`
+}
+
+var cameraNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// loadCameras reads a JSON array of CameraConfig from path.
+func loadCameras(path string) ([]CameraConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCameras(data, path)
+}
+
+// decodeCameras decodes a JSON array of CameraConfig, read from source.
+func decodeCameras(data []byte, source string) ([]CameraConfig, error) {
+	cameras := []CameraConfig{}
+	if err := json.Unmarshal(data, &cameras); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", source, err)
+	}
+	return cameras, nil
+}
+
+// validateCameras checks cameras, loads their zones and lines, and fills in
+// defaults from c.
+func validateCameras(cameras []CameraConfig, c DarknetDConfig) error {
+	if len(cameras) == 0 {
+		return fmt.Errorf("At least 1 camera is required")
+	}
+	names := map[string]bool{}
+	archiveDirs := map[string]bool{}
+	for i := range cameras {
+		cam := &cameras[i]
+		if !cameraNameRe.MatchString(cam.Name) {
+			return fmt.Errorf("Invalid camera %d: Name must be letters, digits, - or _", i)
+		}
+		if names[cam.Name] {
+			return fmt.Errorf("Invalid camera %s: duplicate Name", cam.Name)
+		}
+		names[cam.Name] = true
+		if cam.CaptureDir == "" || cam.ArchiveDir == "" {
+			return fmt.Errorf("Invalid camera %s: CaptureDir and ArchiveDir are required", cam.Name)
+		}
+		if archiveDirs[cam.ArchiveDir] {
+			return fmt.Errorf("Invalid camera %s: ArchiveDir is shared with another camera", cam.Name)
+		}
+		archiveDirs[cam.ArchiveDir] = true
+		if cam.CaptureFile == "" {
+			cam.CaptureFile = c.capFile
+		}
+		if cam.ArchiveFiles == 0 {
+			cam.ArchiveFiles = c.archiveFiles
+		}
+		if cam.Weight == 0 {
+			cam.Weight = 1
+		}
+		if cam.Weight < 0 {
+			return fmt.Errorf("Invalid camera %s: Weight must be positive", cam.Name)
+		}
+		if cam.Backlog == "" {
+			cam.Backlog = c.backlog
+		}
+		if _, err := parseBacklog(cam.Backlog); err != nil {
+			return fmt.Errorf("Invalid camera %s: Backlog %s", cam.Name, err)
+		}
+		if cam.URL != "" {
+			if u, err := url.Parse(cam.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("Invalid camera %s: URL must be an http or https URL", cam.Name)
+			}
+		}
+		if cam.MotionMask == "" {
+			cam.MotionMask = c.motionMask
+		}
+		var err error
+		if cam.MotionMask != "" {
+			if cam.motionMask, err = loadMotionMask(cam.MotionMask); err != nil {
+				return fmt.Errorf("Invalid camera %s: %s", cam.Name, err)
+			}
+		}
+		cam.interval = c.captureInterval
+		if cam.Interval != "" {
+			if cam.interval, err = time.ParseDuration(cam.Interval); err != nil || cam.interval <= 0 {
+				return fmt.Errorf("Invalid camera %s: Interval must be a positive duration such as 500ms", cam.Name)
+			}
+		}
+		if cam.ZonesFile != "" {
+			if cam.Zones, err = loadZones(cam.ZonesFile); err != nil {
+				return fmt.Errorf("Invalid camera %s: %s", cam.Name, err)
+			}
+		} else if cam.Zones != nil {
+			if err := validateZones(cam.Zones); err != nil {
+				return fmt.Errorf("Invalid camera %s: %s", cam.Name, err)
+			}
+		} else {
+			cam.Zones = c.zones
+		}
+		if cam.LinesFile != "" {
+			if cam.Lines, err = loadLines(cam.LinesFile); err != nil {
+				return fmt.Errorf("Invalid camera %s: %s", cam.Name, err)
+			}
+		} else if cam.Lines != nil {
+			if err := validateLines(cam.Lines); err != nil {
+				return fmt.Errorf("Invalid camera %s: %s", cam.Name, err)
+			}
+		} else {
+			cam.Lines = c.lines
+		}
+		if len(cam.Lines) > 0 && c.trackIoU == 0 {
+			return fmt.Errorf("Invalid camera %s: lines require tracking, set --track-iou above 0", cam.Name)
+		}
+	}
+	return nil
+}
+
+// newCamera sets up a camera, with its metrics labelled by name.
+func newCamera(c CameraConfig, config DarknetDConfig, m Metrics) *Camera {
+	labels := prometheus.Labels{"camera": c.Name}
+	cam := &Camera{
+		CameraConfig: c,
+		detections:   &ring.Ring{},
+		detected:     m.Detections.MustCurryWith(labels),
+		jobErrors:    m.JobErrors.WithLabelValues(c.Name),
+		ingested:     m.IngestedImages.WithLabelValues(c.Name),
+		predTime:     m.PredTime.MustCurryWith(labels),
+		totalTime:    m.TotalTime.MustCurryWith(labels),
+	}
+	cam.detections.SetCapacity(cameraRecentResults)
+	policy, _ := parseBacklog(c.Backlog) // checked by validateCameras
+	cam.queue = newImageQueue(policy, m.QueuedImages.WithLabelValues(c.Name), m.DroppedImages.MustCurryWith(labels))
+	// always set up, so a reload can enable them
+	cam.tracker = newTracker(config.trackIoU, config.trackMaxAge, trackerMetrics{
+		started: m.TracksStarted.MustCurryWith(labels),
+		ended:   m.TracksEnded.MustCurryWith(labels),
+		active:  m.TracksActive.MustCurryWith(labels),
+		dwell:   m.TrackDwell.MustCurryWith(labels),
+	})
+	cam.motion = newMotionGate(m.MotionFrames.MustCurryWith(labels), m.MotionSkipRatio.With(labels))
+	cam.motion.configure(config.motionThreshold, config.motionHeartbeat, c.motionMask)
+	cam.lines = newLines(c.Lines, c.ArchiveDir, m.LineCrossings.MustCurryWith(labels))
+	cam.zones = newZones(c.Zones, c.ArchiveDir, m.ZoneObjects.MustCurryWith(labels), m.ZoneEvents.MustCurryWith(labels))
+	cam.logSettings()
+	return cam
+}
+
+// logSettings logs the zones and lines the camera is watching.
+func (cam *Camera) logSettings() {
+	if len(cam.Lines) > 0 {
+		log.Printf("Camera %s: counting %d lines", cam.Name, len(cam.Lines))
+	}
+	if len(cam.Zones) > 0 {
+		log.Printf("Camera %s: watching %d zones", cam.Name, len(cam.Zones))
+	}
+}
+
+// camera returns the camera called name, or nil.
+func (dd *DarknetD) camera(name string) *Camera {
+	for _, cam := range dd.cameras {
+		if cam.Name == name {
+			return cam
+		}
+	}
+	return nil
+}
+
+// archiveDir returns the archive directory of the named camera, or "" if
+// there is no such camera, e.g. for uploaded images.
+func (dd *DarknetD) archiveDir(camera string) string {
+	if cam := dd.camera(camera); cam != nil {
+		return cam.ArchiveDir
+	}
+	return ""
+}
+
+// nextCamera picks the camera to run the next detection on, using smooth
+// weighted round-robin so a camera with Weight 3 runs 3 times as often as
+// one with Weight 1, interleaved rather than in bursts. Cameras are only
+// picked when they have an image queued; nextCamera returns nil if no camera
+// is ready. Only the jobs manager calls it.
+func (dd *DarknetD) nextCamera() *Camera {
+	dd.configmtx.RLock()
+	defer dd.configmtx.RUnlock()
+	total := 0
+	var next *Camera
+	for _, cam := range dd.cameras {
+		if cam.queue.len() == 0 {
+			continue
+		}
+		cam.current += cam.Weight
+		total += cam.Weight
+		if next == nil || cam.current > next.current {
+			next = cam
+		}
+	}
+	if next != nil {
+		next.current -= total
+	}
+	return next
+}
+
+// watchCamera starts watching the camera's archive for new images, leaving
+// it polling if that fails.
+func (dd *DarknetD) watchCamera(cam *Camera) {
+	errors := dd.metrics.WatchErrors.MustCurryWith(prometheus.Labels{"camera": cam.Name})
+	watcher, err := watchImages(cam.ArchiveDir, func(name string) { dd.imageReady(cam, name) }, errors)
+	if err != nil {
+		log.Printf("Camera %s: error watching %s, polling instead: %s", cam.Name, cam.ArchiveDir, err)
+		return
+	}
+	cam.watcher = watcher
+	log.Printf("Camera %s: watching %s for new images", cam.Name, cam.ArchiveDir)
+}
+
+// imageReady queues a new image of cam and wakes the jobs manager.
+func (dd *DarknetD) imageReady(cam *Camera, name string) {
+	if !cam.queue.push(name) {
+		return
+	}
+	select {
+	case dd.imagesReady <- struct{}{}:
+	default:
+	}
+}
+
+// startSource starts pulling frames from the camera's URL into its archive.
+func (dd *DarknetD) startSource(cam *Camera) {
+	labels := prometheus.Labels{"camera": cam.Name}
+	cam.source = startFrameSource(
+		cam.CameraConfig,
+		func() time.Duration {
+			dd.configmtx.RLock()
+			defer dd.configmtx.RUnlock()
+			return cam.interval
+		},
+		sourceMetrics{
+			frames:     dd.metrics.SourceFrames.With(labels),
+			errors:     dd.metrics.SourceErrors.MustCurryWith(labels),
+			up:         dd.metrics.SourceUp.With(labels),
+			reconnects: dd.metrics.SourceReconnects.With(labels),
+		},
+	)
+}
+
+// pollCameras queues the new images in the archives of the cameras that
+// aren't watched.
+func (dd *DarknetD) pollCameras() {
+	for _, cam := range dd.cameras {
+		if cam.watcher != nil {
+			continue
+		}
+		if err := cam.queue.scan(cam.ArchiveDir); err != nil {
+			log.Printf("Error polling camera %s at %s: %s", cam.Name, cam.ArchiveDir, err)
+			cam.jobErrors.Add(1)
+		}
+	}
+}
+
+// cameraStatus returns the cameras with their latest detections.
+func (dd *DarknetD) cameraStatus() []CameraStatus {
+	status := []CameraStatus{}
+	for _, cam := range dd.cameras {
+		dd.configmtx.RLock()
+		s := CameraStatus{Name: cam.Name, Weight: cam.Weight}
+		dd.configmtx.RUnlock()
+		if cam.source != nil {
+			health := cam.source.getHealth()
+			s.Source = &health
+		}
+		if recent := dd.recentDetections(cam); len(recent) > 0 {
+			s.Latest = &recent[len(recent)-1]
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+func sortByID(results []DarknetResult) {
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMultipleCameras(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	dir := newTestDir(t)
+	writeFile(t, filepath.Join(dir, "cameras.json"), strings.Replace(`[
+		{"Name": "front", "CaptureDir": "DIR/cap", "ArchiveDir": "DIR/archive"},
+		{"Name": "back", "CaptureDir": "DIR/cap2", "ArchiveDir": "DIR/archive2", "Weight": 2}
+	]`, "DIR", dir, -1))
+	td := startTestDaemon(t, dir, "--cameras-file=DIR/cameras.json")
+
+	td.capture("image1.jpg")
+	capture(t, filepath.Join(dir, "archive2"), "back1.jpg")
+	if lr := td.waitForImage("/cameras/back/objects", "back1.jpg"); lr.Camera != "back" || lr.Model != "yolov3-tiny" {
+		t.Errorf("Unexpected back result %+v", lr)
+	}
+	if lr := td.waitForImage("/cameras/front/objects", "image1.jpg"); lr.Camera != "front" {
+		t.Errorf("Unexpected front result %+v", lr)
+	}
+	for _, query := range []string{"/cameras/back/objects", "/objects?camera=back"} {
+		results := []DarknetResult{}
+		td.getJSON(query, &results)
+		for _, lr := range results {
+			if lr.Camera != "back" {
+				t.Errorf("%s returned %+v", query, lr)
+			}
+		}
+	}
+	if _, ok := findImage(td.objects(""), "image1.jpg"); !ok {
+		t.Errorf("/objects missing front results")
+	}
+	if status, body := td.get("/cameras/back/image/back1.jpg"); status != http.StatusOK || body != fakeJPEG("back1.jpg") {
+		t.Errorf("/cameras/back/image/back1.jpg: %d %q", status, body)
+	}
+	if status, _ := td.get("/cameras/nope/objects"); status != http.StatusNotFound {
+		t.Errorf("Unknown camera: %d", status)
+	}
+	cameras := []CameraStatus{}
+	td.getJSON("/cameras", &cameras)
+	if len(cameras) != 2 || cameras[1].Name != "back" || cameras[1].Weight != 2 || cameras[1].Latest == nil {
+		t.Errorf("/cameras returned %+v", cameras)
+	}
+	if n := td.detections("back", "yolov3-tiny"); n != 1 {
+		t.Errorf("Expected 1 detection for back, got %d", n)
+	}
+}
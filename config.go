@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A --config file is YAML (or JSON) holding any of the options in usage, by
+// name without the leading dashes, plus structured sections that would
+// otherwise need their own JSON files:
+//
+//	detect-delay: 250ms
+//	history-days: 7
+//	mqtt-broker: tcp://localhost:1883
+//	cameras:
+//	  - Name: front
+//	    CaptureDir: /tmp/front
+//	    ArchiveDir: /tmp/front/cap
+//	zones: [...]
+//	lines: [...]
+//	webhooks: [...]
+//	models: [...]
+//
+// Sections take the same fields as their JSON files. Options given on the
+// command line win over the file, and a section is ignored when its -file
+// option is given on the command line.
+
+// configSections maps each config file section to the option it replaces.
+var configSections = map[string]string{
+	"cameras":  "--cameras-file",
+	"zones":    "--zones-file",
+	"lines":    "--lines-file",
+	"webhooks": "--webhooks-file",
+	"models":   "--models-file",
+}
+
+// usageOption matches an option in usage, capturing its name and placeholder.
+var usageOption = regexp.MustCompile(`(?m)^\s+(?:-\w, )?--([a-z0-9-]+)(?:=<([^>]+)>)?`)
+
+// loadConfigFile merges the settings from the config file at path into args,
+// the parsed docopt options, skipping options set in cmdline. It returns the
+// structured sections, re-encoded as JSON for the section parsers.
+func loadConfigFile(path string, args map[string]interface{}, cmdline []string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config: %s", err)
+	}
+	settings := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	options := map[string]string{}
+	for _, m := range usageOption.FindAllStringSubmatch(usage, -1) {
+		options[m[1]] = m[2]
+	}
+	delete(options, "config")
+	delete(options, "help")
+	delete(options, "version")
+
+	keys := []string{}
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // report errors deterministically
+	sections := map[string][]byte{}
+	for _, key := range keys {
+		value := settings[key]
+		if option, ok := configSections[key]; ok {
+			if _, ok := settings[strings.TrimPrefix(option, "--")]; ok {
+				return nil, fmt.Errorf("Invalid %s: set %s or %s, not both", path, key, strings.TrimPrefix(option, "--"))
+			}
+			if onCommandLine(cmdline, option) {
+				continue
+			}
+			if sections[key], err = json.Marshal(value); err != nil {
+				return nil, fmt.Errorf("Invalid %s in %s: %s", key, path, err)
+			}
+			continue
+		}
+		placeholder, ok := options[key]
+		if !ok {
+			return nil, fmt.Errorf("Unknown setting %s in %s", key, path)
+		}
+		if onCommandLine(cmdline, "--"+key) {
+			continue
+		}
+		if args["--"+key], err = optionValue(value, placeholder); err != nil {
+			return nil, fmt.Errorf("Invalid %s in %s: %s", key, path, err)
+		}
+	}
+	return sections, nil
+}
+
+// onCommandLine reports whether option was given in cmdline.
+func onCommandLine(cmdline []string, option string) bool {
+	for _, arg := range cmdline {
+		if arg == option || strings.HasPrefix(arg, option+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// optionValue converts a config file value to what docopt would have parsed
+// from the command line: a bool for switches, otherwise a string. Options in
+// msec also accept durations such as "1.5s".
+func optionValue(v interface{}, placeholder string) (interface{}, error) {
+	if placeholder == "" {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected true or false")
+		}
+		return b, nil
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if placeholder == "msec" {
+			if d, err := time.ParseDuration(v); err == nil {
+				return strconv.FormatInt(int64(d/time.Millisecond), 10), nil
+			}
+		}
+		return v, nil
+	case int, float64, bool:
+		return fmt.Sprint(v), nil
+	}
+	return nil, fmt.Errorf("expected a single value")
+}
+
+// validatePaths checks that the files darknetd needs at startup exist, so a
+// bad path is reported before darknet is started.
+func validatePaths(c DarknetDConfig) error {
+	if fi, err := os.Stat(c.darknetDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("Invalid --darknet-dir: %s is not a directory", c.darknetDir)
+	}
+	files := map[string]string{"--darknet-dir": "darknet"}
+	if len(c.models) == 0 {
+		files["--darknet-data"] = c.darknetDataFile
+		files["--model-config"] = c.modelConfigFile
+		files["--model-weights"] = c.modelWeightsFile
+	}
+	for option, file := range files {
+		path := filepath.Join(c.darknetDir, file)
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			return fmt.Errorf("Invalid %s: %s is not a file", option, path)
+		}
+	}
+	for _, m := range c.models {
+		if err := checkModelFiles(m, c.darknetDir); err != nil {
+			return err
+		}
+	}
+	for _, cam := range c.cameras {
+		if fi, err := os.Stat(cam.CaptureDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("Invalid camera %s: CaptureDir %s is not a directory", cam.Name, cam.CaptureDir)
+		}
+		if fi, err := os.Stat(cam.ArchiveDir); err == nil && !fi.IsDir() {
+			return fmt.Errorf("Invalid camera %s: ArchiveDir %s is not a directory", cam.Name, cam.ArchiveDir)
+		}
+	}
+	return nil
+}
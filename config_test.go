@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir := newTestDir(t)
+	writeBand(t, filepath.Join(dir, "black.png"), 0, 0)
+	for _, tc := range []struct {
+		config string
+		args   []string
+		err    string // "" if the config is valid
+	}{
+		{config: `detect-delay: 250ms
+history-days: 7
+mqtt-retain: true
+cameras:
+  - Name: front
+    CaptureDir: DIR/cap
+    ArchiveDir: DIR/archive
+    Zones:
+      - Name: door
+        Points: [[300, 300], [500, 300], [500, 450]]
+  - Name: back
+    CaptureDir: DIR/cap2
+    ArchiveDir: DIR/archive2
+lines:
+  - Name: gate
+    Points: [[0, 400], [640, 400]]
+webhooks:
+  - Name: people
+    URL: http://127.0.0.1:1/
+    Classes: [person]
+`},
+		{config: "detect-timeout: -5\n", err: "Invalid --detect-timeout"},
+		{config: "detect-timeout: -5\n", args: []string{"--detect-timeout=1000"}},
+		{config: "detect-dely: 100\n", err: "Unknown setting detect-dely"},
+		{config: "zones:\n  - Name: door\n    Points: [[0, 0], [1, 1]]\n", err: "Invalid zone door"},
+		{config: "model-weights: missing.weights\n", err: "Invalid --model-weights"},
+		{config: "motion-threshold: 0.05\nmotion-mask: DIR/black.png\n", err: "Invalid camera default: Motion mask"},
+		{config: "cameras:\n  - Name: front\n    CaptureDir: DIR/cap\n    ArchiveDir: DIR/archive\n  - Name: front\n    CaptureDir: DIR/cap2\n    ArchiveDir: DIR/archive2\n", err: "Invalid camera front: duplicate Name"},
+		{config: "lines:\n  - Name: gate\n    Points: [[0, 400], [640, 400]]\ntrack-iou: 0\n", err: "lines require tracking"},
+		{config: "backlog: some\n", err: "Invalid --backlog"},
+	} {
+		writeFile(t, filepath.Join(dir, "config.yaml"), strings.Replace(tc.config, "DIR", dir, -1))
+		// only the config file and tc.args override the defaults
+		argv := []string{"--config=" + filepath.Join(dir, "config.yaml"), "--darknet-dir=" + filepath.Join(dir, "darknet"), "--history-file="}
+		_, err := getConfig(append(argv, tc.args...))
+		if tc.err == "" && err != nil {
+			t.Errorf("Config %q %v: %s", tc.config, tc.args, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("Config %q %v: expected %q, got %v", tc.config, tc.args, tc.err, err)
+		}
+	}
+}
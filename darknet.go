@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const darknetPrompt = "Enter Image Path:"
+
+// darknetDetector drives the `darknet detector test` REPL over stdin/stdout.
+type darknetDetector struct {
+	config        DarknetDConfig
+	model         Model
+	unknownOutput prometheus.Counter
+
+	// private runs darknet in a temporary mirror of darknetDir, so it writes
+	// predictions.jpg there rather than over another process's.
+	private bool
+	dir     string
+
+	cmd     *exec.Cmd
+	cmdin   io.WriteCloser
+	cmdout  *bufio.Reader
+	parser  outputParser
+	done    chan struct{}
+	exitErr error
+
+	stderr    []string
+	stderrmtx sync.Mutex
+}
+
+func newDarknetDetector(config DarknetDConfig, model Model, unknownOutput prometheus.Counter) *darknetDetector {
+	return &darknetDetector{
+		config:        config,
+		model:         model,
+		unknownOutput: unknownOutput,
+		done:          make(chan struct{}),
+	}
+}
+
+func (d *darknetDetector) Start() error {
+	flavor := d.config.darknetFlavor
+	banner, err := d.start(darknetFlavors[flavor].args)
+	if err != nil {
+		return err
+	}
+	if flavor == "auto" {
+		flavor = detectFlavor(banner)
+		// the fork is only known once darknet has started, so restart it
+		// with the arguments the fork needs
+		if args := darknetFlavors[flavor].args; len(args) > 0 {
+			log.Printf("Detected %s darknet, restarting it with %s", flavor, strings.Join(args, " "))
+			if err := d.Close(); err != nil {
+				return err
+			}
+			if _, err := d.start(args); err != nil {
+				return err
+			}
+		}
+	}
+	d.parser = darknetFlavors[flavor].parse
+	log.Printf("Started darknet process %d for model %s, parsing %s output", d.cmd.Process.Pid, d.model.Name, flavor)
+	return nil
+}
+
+// start runs darknet with extraArgs after the model files, and waits for its
+// first prompt. It returns darknet's startup output, stdout then stderr.
+func (d *darknetDetector) start(extraArgs []string) ([]string, error) {
+	d.cmd = nil
+	d.done = make(chan struct{})
+	d.stderrmtx.Lock()
+	d.stderr = nil
+	d.stderrmtx.Unlock()
+	d.dir = d.config.darknetDir
+	if d.private {
+		dir, err := mirrorDir(d.config.darknetDir)
+		if err != nil {
+			return nil, err
+		}
+		d.dir = dir
+	}
+	args := append([]string{"detector", "test", d.model.Data, d.model.Config, d.model.Weights}, extraArgs...)
+	c := "./darknet"
+	log.Printf("EXEC %s %s", c, strings.Join(args, " "))
+	cmd := exec.Command(c, args...)
+	cmd.Dir = d.dir
+	cmderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	d.cmdout = bufio.NewReader(cmdout)
+	d.cmdin, err = cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan []string, 1)
+	execErr := make(chan error, 1)
+
+	go func(cmdout *bufio.Reader) {
+		banner, err := readUntilPrompt(cmdout)
+		if err != nil {
+			if err != io.EOF {
+				execErr <- fmt.Errorf("Error reading from darknet stdout on process start: %+v\n", err)
+			}
+			return
+		}
+		ready <- banner
+	}(d.cmdout)
+
+	go func(cmderr io.ReadCloser) {
+		reader := bufio.NewReader(cmderr)
+		var err error
+		err = nil
+		for err == nil {
+			e, err := reader.ReadString('\n') // ignore stderr - would be nice to show this on failure
+			if err != nil {
+				break
+			}
+			log.Printf("[stderr] %s\n", e)
+			d.stderrmtx.Lock()
+			if len(d.stderr) < darknetBannerLines {
+				d.stderr = append(d.stderr, e)
+			}
+			d.stderrmtx.Unlock()
+		}
+		if err != nil && err != io.EOF {
+			log.Printf("Error reading from darknet stderr on process start: %+v", err)
+			return
+		}
+		return
+	}(cmderr)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	d.cmd = cmd
+	go func() {
+		d.exitErr = cmd.Wait()
+		close(d.done)
+	}()
+
+	var banner []string
+	select {
+	case banner = <-ready:
+		break
+	case err := <-execErr:
+		d.Close()
+		return nil, fmt.Errorf("Darknet stdout err on start: %s", err)
+	case <-d.done:
+		if d.exitErr != nil {
+			return nil, fmt.Errorf("Darknet start error: %s", d.exitErr)
+		}
+		return nil, fmt.Errorf("Darknet exited on start")
+	case <-time.After(d.config.darknetStartTimeout):
+		d.Close()
+		return nil, fmt.Errorf("Timed out starting darknet")
+	}
+	d.stderrmtx.Lock()
+	defer d.stderrmtx.Unlock()
+	return append(banner, d.stderr...), nil
+}
+
+func (d *darknetDetector) Detect(imgPath, predPath string) (DarknetResult, error) {
+	// darknet runs in its own directory
+	imgPath, err := filepath.Abs(imgPath)
+	if err != nil {
+		return DarknetResult{}, err
+	}
+	// log.Printf("calling darknet detect on %s", imgPath)
+	if _, err := fmt.Fprintln(d.cmdin, imgPath); err != nil {
+		return DarknetResult{}, detectorError{fmt.Errorf("Error writing to darknet stdin: %s", err), true}
+	}
+
+	lines, err := readUntilPrompt(d.cmdout)
+	if err == io.EOF {
+		return DarknetResult{}, detectorError{fmt.Errorf("Darknet stdout closed before prompt: %q", lines), true}
+	}
+	if err != nil {
+		return DarknetResult{}, detectorError{fmt.Errorf("Error reading from darknet stdout: %+v\t%q\n", err, lines), true}
+	}
+
+	darknetResult, unknown := d.parser(imgPath, lines)
+	d.unknownOutput.Add(float64(len(unknown)))
+
+	if predPath == "" {
+		return darknetResult, nil
+	}
+	predImg, err := ioutil.ReadFile(filepath.Join(d.dir, "predictions.jpg"))
+	if err != nil {
+		return DarknetResult{}, detectorError{err, false}
+	}
+	if err := ioutil.WriteFile(predPath, predImg, 0644); err != nil {
+		return DarknetResult{}, err
+	}
+	return darknetResult, nil
+}
+
+func (d *darknetDetector) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *darknetDetector) Err() error {
+	select {
+	case <-d.done:
+		return fmt.Errorf("Darknet process %d exited: %v", d.cmd.Process.Pid, d.exitErr)
+	default:
+		return nil
+	}
+}
+
+// Close kills the darknet process, if still running, and waits for it to exit.
+func (d *darknetDetector) Close() error {
+	if d.private && d.dir != "" {
+		defer os.RemoveAll(d.dir) // only removes the links
+	}
+	if d.cmd == nil {
+		return nil
+	}
+	d.cmdin.Close()
+	select {
+	case <-d.done:
+		return nil
+	default:
+	}
+	if err := d.cmd.Process.Kill(); err != nil {
+		log.Printf("Error killing darknet process %d: %s", d.cmd.Process.Pid, err)
+	}
+	select {
+	case <-d.done:
+		return nil
+	case <-time.After(darknetStopTimeout):
+		return fmt.Errorf("Timed out waiting for darknet process %d to exit", d.cmd.Process.Pid)
+	}
+}
+
+// mirrorDir creates a temporary directory of links to the files in dir, except
+// darknet's prediction images.
+func mirrorDir(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	mirror, err := ioutil.TempDir("", "darknetd-")
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "predictions.") {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dir, f.Name()), filepath.Join(mirror, f.Name())); err != nil {
+			os.RemoveAll(mirror)
+			return "", err
+		}
+	}
+	return mirror, nil
+}
+
+// readUntilPrompt reads darknet stdout up to and including the next prompt,
+// returning the lines before it.
+func readUntilPrompt(r *bufio.Reader) ([]string, error) {
+	var out strings.Builder
+	for {
+		s, err := r.ReadString(':')
+		out.WriteString(s)
+		if strings.HasSuffix(out.String(), darknetPrompt) {
+			return strings.Split(strings.TrimSuffix(out.String(), darknetPrompt), "\n"), nil
+		}
+		if err != nil {
+			return strings.Split(out.String(), "\n"), err
+		}
+	}
+}
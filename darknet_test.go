@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// darknetArgs returns the arguments darknet was started with.
+func (td *testDaemon) darknetArgs() []string {
+	td.cmdmtx.Lock()
+	defer td.cmdmtx.Unlock()
+	d, ok := td.detector.(*darknetDetector)
+	if !ok {
+		td.t.Fatalf("Detector is a %T", td.detector)
+	}
+	return d.cmd.Args[1:]
+}
+
+func TestOutputFlavors(t *testing.T) {
+	for _, tc := range []struct {
+		fixture, flavor, banner string
+		timeDetect              float64
+		args                    []string // after the model files
+	}{
+		{fixture: "pjreddie", flavor: "pjreddie", timeDetect: 0.412035},
+		{fixture: "pjreddie", flavor: "nnpack", timeDetect: 0.412035},
+		{fixture: "pjreddie", flavor: "auto", timeDetect: 0.412035},
+		{fixture: "alexeyab", flavor: "alexeyab", timeDetect: 0.048213, args: []string{"-ext_output", "-dont_show"}},
+		{fixture: "alexeyab", flavor: "auto", banner: "alexeyab-banner", timeDetect: 0.048213, args: []string{"-ext_output", "-dont_show"}},
+		{fixture: "alexeyab-stock", flavor: "alexeyab", timeDetect: 0.048213, args: []string{"-ext_output", "-dont_show"}},
+		{fixture: "alexeyab-stock", flavor: "auto", banner: "alexeyab-banner", timeDetect: 0.048213, args: []string{"-ext_output", "-dont_show"}},
+	} {
+		t.Run(tc.fixture+"/"+tc.flavor, func(t *testing.T) {
+			t.Setenv("FAKEDARKNET_FIXTURE", fixture(tc.fixture))
+			if tc.banner != "" {
+				t.Setenv("FAKEDARKNET_BANNER", fixture(tc.banner))
+			}
+			td := startTestDaemon(t, newTestDir(t), "--darknet-flavor="+tc.flavor)
+			args := append([]string{"detector", "test", "cfg/coco.data", "cfg/yolov3-tiny.cfg", "yolov3-tiny.weights"}, tc.args...)
+			if got := td.darknetArgs(); !reflect.DeepEqual(got, args) {
+				t.Errorf("Darknet run with %v", got)
+			}
+
+			td.timelapse()
+			// each fixture output in turn
+			waitFor(t, "3 detections", func() bool { return td.detections("default", "yolov3-tiny") >= 3 })
+			var found *Object
+			for _, lr := range td.objects("?class=traffic%20light") {
+				if lr.TimeDetect != tc.timeDetect {
+					t.Errorf("TimeDetect is %v", lr.TimeDetect)
+				}
+				o := lr.Objects[0]
+				o.TrackID, o.Dwell = 0, 0
+				found = &o
+			}
+			want := Object{Class: "traffic light", Prob: 71, Left: 20, Right: 44, Top: 10, Bot: 80, Model: "yolov3-tiny"}
+			if found == nil || !reflect.DeepEqual(*found, want) {
+				t.Errorf("Expected %+v, got %+v", want, found)
+			}
+			if n := testutil.ToFloat64(td.metrics.UnknownOutput); n != 0 {
+				t.Errorf("%v unknown output lines", n)
+			}
+		})
+	}
+}
@@ -1,255 +1,375 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/zfjagann/golang-ring"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-func startDarknet(darknetConfig DarknetDConfig) (DarknetD, error) {
-	dd := DarknetD{
+var errDarknetNotRunning = fmt.Errorf("Darknet is not running")
+
+// newDarknetD sets up darknetd to run with darknetConfig, registering its
+// metrics with reg.
+func newDarknetD(darknetConfig DarknetDConfig, reg prometheus.Registerer) *DarknetD {
+	dd := &DarknetD{
 		config:        darknetConfig,
 		detectionsmtx: sync.RWMutex{},
-		detections:    &ring.Ring{},
 		cmdmtx:        sync.Mutex{},
+		failures:      make(chan error, 1),
+		restarts:      make(chan struct{}, 1),
+		switches:      make(chan modelSwitch),
+		imagesReady:   make(chan struct{}, 1),
+		quit:          make(chan struct{}),
+		state:         DarknetState{Status: DARKNET_STOPPED.String()},
 	}
-	dd.metrics = setupMetrics()
-	dd.detections.SetCapacity(10)
-	if err := os.Chdir(dd.config.darknetDir); err != nil {
-		return dd, err
+	dd.metrics = setupMetrics(reg)
+	dd.events = newBroker(dd.metrics.StreamDropped)
+	dd.ingestLimiter = newRateLimiter(func() float64 { return dd.currentConfig().ingestRate })
+	dd.newDetector = func(c DarknetDConfig) Detector {
+		if len(c.models) == 1 {
+			return newDarknetDetector(c, c.models[0], dd.metrics.UnknownOutput)
+		}
+		detectors := []Detector{}
+		for i, m := range c.models {
+			d := newDarknetDetector(c, m, dd.metrics.UnknownOutput)
+			d.private = i > 0
+			detectors = append(detectors, d)
+		}
+		return newMultiDetector(c.models, detectors, c.modelsParallel)
 	}
-	args := []string{"detector", "test", dd.config.darknetDataFile, dd.config.modelConfigFile, dd.config.modelWeightsFile}
-	c := "./darknet"
-	log.Printf("EXEC %s %s", c, strings.Join(args, " "))
-	cmd := exec.Command(c, args...)
-	cmderr, err := cmd.StderrPipe()
-	if err != nil {
-		return dd, err
+	return dd
+}
+
+// start sets up the cameras and the history, starts darknet, and starts the
+// managers feeding it images and the consumers of its detections.
+func (dd *DarknetD) start() error {
+	var err error
+	for _, c := range dd.config.cameras {
+		cam := newCamera(c, dd.config, dd.metrics)
+		if dd.config.pickup == "watch" {
+			dd.watchCamera(cam)
+		}
+		dd.cameras = append(dd.cameras, cam)
 	}
-	dd.cmdout, err = cmd.StdoutPipe()
-	if err != nil {
-		return dd, err
+	for _, cam := range dd.cameras {
+		if cam.URL != "" {
+			dd.startSource(cam)
+		}
 	}
-	dd.cmdin, err = cmd.StdinPipe()
-	if err != nil {
-		return dd, err
+	if dd.config.historyFile != "" {
+		if dd.history, err = openHistory(dd.config.historyFile); err != nil {
+			return fmt.Errorf("Error opening history at %s: %v", dd.config.historyFile, err)
+		}
+	}
+	if err := dd.startSupervisor(); err != nil {
+		return fmt.Errorf("startSupervisor error %v", err)
 	}
 
-	ready := make(chan bool)
-	execErr := make(chan error)
-
-	defer func() {
-		cmderr.Close()
-	}()
-
-	go func(cmdout io.ReadCloser) {
-		scanner := bufio.NewScanner(cmdout)
-		scanner.Split(bufio.ScanWords)
-		for ok := true; ok != false; ok = scanner.Scan() {
-			if strings.HasPrefix(scanner.Text(), "Path:") {
-				ready <- true
-				return
-			}
-		}
-		if scanner.Err() != nil {
-			execErr <- fmt.Errorf("Error reading from darknet stdout on process start: %+v\n", scanner.Err())
+	for _, cam := range dd.cameras {
+		cam := cam
+		if err := startArchiveManager(
+			cam.ArchiveDir,
+			archiveCleanupInterval,
+			func() int {
+				dd.configmtx.RLock()
+				defer dd.configmtx.RUnlock()
+				return cam.ArchiveFiles
+			},
+			cam.queue.forget,
+			dd.metrics.CleanedUpFiles.WithLabelValues(cam.Name),
+			dd.metrics.CleanUpErrors.MustCurryWith(prometheus.Labels{"camera": cam.Name}),
+			dd.quit,
+		); err != nil {
+			return fmt.Errorf("startArchiveManager error %v", err)
 		}
-		return
-	}(dd.cmdout)
-
-	go func(cmderr io.ReadCloser) {
-		reader := bufio.NewReader(cmderr)
-		var err error
-		err = nil
-		for err == nil {
-			e, err := reader.ReadString('\n') // ignore stderr - would be nice to show this on failure
-			if err != nil {
-				break
-			}
-			log.Printf("[stderr] %s\n", e)
+	}
+	if dd.history != nil {
+		if err := startHistoryManager(
+			dd.history,
+			func() time.Duration { return dd.currentConfig().historyRetention },
+			dd.metrics.HistoryCleanedUp,
+			dd.metrics.HistoryErrors,
+			dd.quit,
+		); err != nil {
+			return fmt.Errorf("startHistoryManager error %v", err)
 		}
-		if err != nil && err != io.EOF {
-			log.Printf("Error reading from darknet stderr on process start: %+v", err)
-			return
+	}
+	dd.notifier = newNotifier(dd.archiveDir, notifierMetrics{
+		deliveries: dd.metrics.WebhookDeliveries,
+		retries:    dd.metrics.WebhookRetries,
+		dropped:    dd.metrics.WebhookDropped,
+	})
+	if err := dd.notifier.start(dd.config.webhooks); err != nil {
+		return fmt.Errorf("Error starting webhooks: %v", err)
+	}
+	if len(dd.config.webhooks) > 0 {
+		log.Printf("Sending webhooks for %d rules", len(dd.config.webhooks))
+	}
+	if dd.config.mqtt.broker != "" {
+		dd.publisher = newMQTTPublisher(dd.config.mqtt, dd.metrics.MQTTMessages, dd.metrics.MQTTConnected)
+		if err := dd.publisher.start(dd); err != nil {
+			return fmt.Errorf("Error starting MQTT publisher: %v", err)
 		}
-		return
-	}(cmderr)
+	}
+	if err := dd.startJobsManager(); err != nil {
+		return fmt.Errorf("startJobsManager error %v", err)
+	}
+	return nil
+}
 
-	if err := cmd.Start(); err != nil {
-		return dd, err
+// stop stops what start started, waiting for darknet to exit and for the
+// jobs manager to finish the detection it is running.
+func (dd *DarknetD) stop() {
+	close(dd.quit)
+	for _, cam := range dd.cameras {
+		if cam.watcher != nil {
+			cam.watcher.close()
+		}
+		if cam.source != nil {
+			cam.source.close()
+		}
+	}
+	dd.workers.Wait()
+	if dd.publisher != nil {
+		dd.publisher.stop()
+	}
+	if dd.history != nil {
+		dd.history.Close()
 	}
+}
 
-	earlyExit := make(chan error)
-	go func() { earlyExit <- cmd.Wait() }()
+// currentConfig returns the config, which may be replaced by a reload.
+func (dd *DarknetD) currentConfig() DarknetDConfig {
+	dd.configmtx.RLock()
+	defer dd.configmtx.RUnlock()
+	return dd.config
+}
 
-	select {
-	case _ = <-ready:
-		break
-	case err := <-execErr:
-		return dd, fmt.Errorf("Darknet stdout err on start: %s", err)
-	case err := <-earlyExit:
-		if err != nil {
-			return dd, fmt.Errorf("Darknet start error: %s", err)
-		}
-		return dd, fmt.Errorf("Darknet exited on start")
-	case <-time.After(dd.config.darknetStartTimeout):
-		return dd, fmt.Errorf("Timed out starting darknet")
+// stopDetector closes the running detector, if any. Callers must hold cmdmtx.
+func (dd *DarknetD) stopDetector() {
+	if dd.detector == nil {
+		return
+	}
+	if err := dd.detector.Close(); err != nil {
+		log.Printf("Error stopping detector: %s", err)
 	}
-	return dd, nil
+	dd.detector = nil
 }
 
 func (dd *DarknetD) startJobsManager() error {
+	dd.workers.Add(1)
 	go func() {
+		defer dd.workers.Done()
+		detectorErrors := 0
 		for {
-			lr, err := dd.handleJob(dd.config.archiveDir)
+			select {
+			case <-dd.quit:
+				return
+			default:
+			}
+			delay := dd.currentConfig().darknetDetectDelay
+			if dd.getState().status != DARKNET_RUNNING {
+				time.Sleep(delay)
+				continue
+			}
+			dd.pollCameras()
+			for _, cam := range dd.cameras {
+				cam.tracker.expire(time.Now())
+			}
+			cam := dd.nextCamera()
+			if cam == nil { // no camera with a new image
+				select {
+				case <-dd.imagesReady:
+				case <-time.After(delay):
+				case <-dd.quit:
+				}
+				continue
+			}
+			name := cam.queue.pop()
+			if !cam.motion.check(filepath.Join(cam.ArchiveDir, name), time.Now()) {
+				continue
+			}
+			lr, err := dd.handleJob(cam, name)
 			if err != nil {
-				log.Printf("Error handling job at %s: %s", dd.config.archiveDir, err)
-				dd.metrics.JobErrors.Add(1)
-				time.Sleep(dd.config.darknetDetectDelay)
+				log.Printf("Error handling job for camera %s at %s: %s", cam.Name, cam.ArchiveDir, err)
+				cam.jobErrors.Add(1)
+				if derr, ok := err.(detectorError); ok {
+					detectorErrors++
+					if derr.fatal {
+						detectorErrors = 0 // already reported by detect
+					} else if detectorErrors >= darknetMaxJobErrors {
+						dd.reportFailure(fmt.Errorf("%d consecutive darknet job errors, last: %s", detectorErrors, err))
+						detectorErrors = 0
+					}
+				}
+				time.Sleep(delay)
 				continue
 			}
-			dd.detections.Enqueue(lr)
-			dd.metrics.Detections.Add(1)
-			time.Sleep(dd.config.darknetDetectDelay)
+			detectorErrors = 0
+			if cam.tracker.enabled() {
+				moved := cam.tracker.apply(&lr)
+				cam.lines.apply(&lr, moved)
+			}
+			cam.zones.apply(&lr)
+			dd.addDetection(cam, &lr)
+			dd.events.Publish(lr)
+			cam.detected.WithLabelValues(lr.Model).Add(1)
+			if dd.history != nil {
+				if err := dd.history.Add(lr); err != nil {
+					log.Printf("Error adding detection to history: %s", err)
+					dd.metrics.HistoryErrors.WithLabelValues("Add").Add(1)
+				} else {
+					dd.metrics.HistoryRecords.Add(1)
+				}
+			}
+			time.Sleep(delay)
 		}
 	}()
 	return nil
 }
 
-func (dd *DarknetD) handleJob(srcDir string) (DarknetResult, error) {
+// addDetection assigns lr its ID, adds it to the camera's recent detections
+// and evaluates the webhook rules against it. IDs increase across restarts
+// and cameras, so API clients can use them as a cursor.
+func (dd *DarknetD) addDetection(cam *Camera, lr *DarknetResult) {
+	dd.detectionsmtx.Lock()
+	lr.ID = dd.lastID + 1
+	if now := uint64(time.Now().UnixNano()); now > lr.ID {
+		lr.ID = now
+	}
+	dd.lastID = lr.ID
+	cam.detections.Enqueue(*lr)
+	dd.detectionsmtx.Unlock()
+	dd.notifier.evaluate(*lr)
+}
+
+// recentDetections returns the recent detections of cam, or of all cameras
+// if cam is nil, oldest first.
+func (dd *DarknetD) recentDetections(cam *Camera) []DarknetResult {
+	dd.detectionsmtx.RLock()
+	defer dd.detectionsmtx.RUnlock()
+	results := []DarknetResult{}
+	for _, c := range dd.cameras {
+		if cam != nil && c != cam {
+			continue
+		}
+		for _, v := range c.detections.Values() {
+			results = append(results, v.(DarknetResult))
+		}
+	}
+	if cam == nil && len(dd.cameras) > 1 {
+		sortByID(results)
+	}
+	return results
+}
+
+// handleJob runs detection on the named image in the camera's archive.
+func (dd *DarknetD) handleJob(cam *Camera, name string) (DarknetResult, error) {
 	start := time.Now()
 	dd.cmdmtx.Lock()
 	defer dd.cmdmtx.Unlock()
+	if dd.detector == nil {
+		return DarknetResult{}, errDarknetNotRunning
+	}
 
-	imgFile, err := findNewest(srcDir)
+	imgFile, err := os.Stat(filepath.Join(cam.ArchiveDir, name))
 	if err != nil {
 		return DarknetResult{}, err
 	}
 	imgTime := imgFile.ModTime()
 
-	_ = os.Remove(filepath.Join(dd.config.capDir, detectFilename))
-	if err := os.Symlink(filepath.Join(srcDir, imgFile.Name()), filepath.Join(dd.config.capDir, detectFilename)); err != nil {
+	_ = os.Remove(filepath.Join(cam.CaptureDir, detectFilename))
+	if err := os.Symlink(filepath.Join(cam.ArchiveDir, imgFile.Name()), filepath.Join(cam.CaptureDir, detectFilename)); err != nil {
 		return DarknetResult{}, err
 	}
-	defer os.Remove(filepath.Join(dd.config.capDir, detectFilename))
-	// log.Printf("calling darknet detect on %s", filepath.Join(dd.config.capDir, detectFilename))
-	fmt.Fprintln(dd.cmdin, filepath.Join(dd.config.capDir, detectFilename))
-
-	scanner := bufio.NewScanner(dd.cmdout)
-	scanner.Split(bufio.ScanWords)
+	defer os.Remove(filepath.Join(cam.CaptureDir, detectFilename))
 
-	words := []string{}
-	for ok := scanner.Scan(); ok != false; ok = scanner.Scan() {
-		words = append(words, scanner.Text())
-		if scanner.Text() == "Path:" {
-			break
-		}
-	}
-	if scanner.Err() != nil {
-		return DarknetResult{}, fmt.Errorf("Error reading from darknet stdout: %+v\t%v\n", scanner.Err(), words)
-	}
-
-	darknetResult, err := parseOutput(filepath.Join(dd.config.capDir, detectFilename), words)
+	predImgFile := fmt.Sprintf("predictions_%s", imgFile.Name())
+	darknetResult, err := dd.detect(filepath.Join(cam.CaptureDir, detectFilename), filepath.Join(cam.ArchiveDir, predImgFile))
 	if err != nil {
-		return DarknetResult{}, fmt.Errorf("Error parsing darknet output: %s\t%v", err, words)
+		return DarknetResult{}, err
 	}
+	darknetResult.Camera = cam.Name
 	darknetResult.Image = imgFile.Name()
 	darknetResult.ImageTime = imgTime
+	darknetResult.PredImage = predImgFile
+	darknetResult.PredTime = time.Now()
+	darknetResult.TimeTotal = time.Since(start).Seconds()
 
-	predImg, err := ioutil.ReadFile(filepath.Join(dd.config.darknetDir, "predictions.jpg"))
-	if err != nil {
-		return DarknetResult{}, err
+	dd.observePredTime(cam.predTime, darknetResult)
+	cam.totalTime.WithLabelValues(darknetResult.Model).Observe(time.Since(start).Seconds())
+
+	return darknetResult, nil
+}
+
+// detectUpload runs detection on an image outside the archive, such as one
+// uploaded to /detect, sharing the darknet session with the jobs manager.
+func (dd *DarknetD) detectUpload(imgPath, predPath string) (DarknetResult, error) {
+	start := time.Now()
+	dd.cmdmtx.Lock()
+	defer dd.cmdmtx.Unlock()
+	if dd.detector == nil {
+		return DarknetResult{}, errDarknetNotRunning
 	}
-	predImgFile := fmt.Sprintf("predictions_%s", imgFile.Name())
-	dst := filepath.Join(dd.config.archiveDir, predImgFile)
-	err = ioutil.WriteFile(dst, predImg, 0644)
+	darknetResult, err := dd.detect(imgPath, predPath)
 	if err != nil {
 		return DarknetResult{}, err
 	}
-	darknetResult.PredImage = predImgFile
 	darknetResult.PredTime = time.Now()
 	darknetResult.TimeTotal = time.Since(start).Seconds()
-	dd.metrics.Detections.Add(1)
-
-	dd.metrics.PredTime.Observe(darknetResult.TimeDetect)
-	dd.metrics.TotalTime.Observe(time.Since(start).Seconds())
-
+	dd.observePredTime(dd.metrics.PredTime.MustCurryWith(prometheus.Labels{"camera": ""}), darknetResult)
+	dd.metrics.TotalTime.WithLabelValues("", darknetResult.Model).Observe(darknetResult.TimeTotal)
 	return darknetResult, nil
 }
 
-// parseOutput is pretty brittle, but works at least with https://github.com/nmcclain/darknet-nnpack 9faadb1
-func parseOutput(imgFile string, words []string) (DarknetResult, error) {
-	lr := DarknetResult{}
-
-	for i := 0; i < len(words); i++ {
-		switch words[i] {
-		case "Predicted":
-			i += 2 // "Predicted in"
-			var err error
-			lr.TimeDetect, err = strconv.ParseFloat(words[i], 64)
-			if err != nil {
-				log.Printf("Unexpected darknet output: %v: %s", words, err)
-			}
-			i++ // "seconds."
-			unit := words[i]
-			if unit == "milli-seconds." {
-				lr.TimeDetect = lr.TimeDetect / 1000
-			}
-		case "CLASS":
-			o := Object{}
+// observePredTime observes the prediction time of each model in lr.
+func (dd *DarknetD) observePredTime(predTime prometheus.ObserverVec, lr DarknetResult) {
+	if len(lr.ModelTimes) == 0 {
+		predTime.WithLabelValues(lr.Model).Observe(lr.TimeDetect)
+		return
+	}
+	for model, t := range lr.ModelTimes {
+		predTime.WithLabelValues(model).Observe(t)
+	}
+}
 
-			i++
-			o.Class = words[i]
-			i++
+// detect runs the detector on imgPath, giving up after darknetDetectTimeout.
+// A timed out detector is presumed wedged. On fatal errors the detector is
+// stopped right away, so no other caller can use it, and the error is
+// reported to the supervisor so it starts a new one. Callers must hold cmdmtx.
+func (dd *DarknetD) detect(imgPath, predPath string) (DarknetResult, error) {
+	type detection struct {
+		result DarknetResult
+		err    error
+	}
+	done := make(chan detection, 1)
+	go func(detector Detector) {
+		r, err := detector.Detect(imgPath, predPath)
+		done <- detection{r, err}
+	}(dd.detector)
 
-			var err error
-			o.Prob, err = strconv.Atoi(words[i])
-			if err != nil {
-				log.Printf("Unexpected darknet output: %v: %s", words, err)
-			}
-			i += 2 // "BBOX"
-			o.Left, err = strconv.Atoi(words[i])
-			if err != nil {
-				log.Printf("Unexpected darknet output: %v: %s", words, err)
-			}
-			i++
-			o.Right, err = strconv.Atoi(words[i])
-			if err != nil {
-				log.Printf("Unexpected darknet output: %v: %s", words, err)
-			}
-			i++
-			o.Top, err = strconv.Atoi(words[i])
-			if err != nil {
-				log.Printf("Unexpected darknet output: %v: %s", words, err)
-			}
-			i++
-			o.Bot, err = strconv.Atoi(words[i])
-			if err != nil {
-				log.Printf("Unexpected darknet output: %v: %s", words, err)
-			}
-			lr.Objects = append(lr.Objects, o)
-		case "Enter":
-			break
-		case "Image":
-			break
-		case "Path:":
-			break
-		case fmt.Sprintf("%s:", imgFile):
-			break
-		default:
-			log.Printf("Unexpected darknet output: %v", words)
+	timeout := dd.currentConfig().darknetDetectTimeout
+	var d detection
+	select {
+	case d = <-done:
+	case <-time.After(timeout):
+		dd.metrics.DetectTimeouts.Add(1)
+		d.err = detectorError{fmt.Errorf("Darknet detection timed out after %v on %s", timeout, imgPath), true}
+	}
+	if derr, ok := d.err.(detectorError); ok && derr.fatal {
+		dd.reportFailure(d.err)
+		dd.stopDetector()
+	}
+	d.result.Model = modelNames(dd.models)
+	for i := range d.result.Objects {
+		if d.result.Objects[i].Model == "" {
+			d.result.Objects[i].Model = dd.models[0].Name
 		}
 	}
-	return lr, nil
+	return d.result, d.err
 }
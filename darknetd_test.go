@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakedarknetBin is fakedarknet, built by TestMain, which test daemons run as
+// their darknet.
+var fakedarknetBin string
+
+// fixturesDir holds the fakedarknet fixtures. Its path is absolute, as
+// darknet runs in the darknet dir.
+var fixturesDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	if fixturesDir, err = filepath.Abs(filepath.Join("fakedarknet", "fixtures")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	dir, err := ioutil.TempDir("", "darknetd-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fakedarknetBin = filepath.Join(dir, "darknet")
+	build := exec.Command("go", "build", "-o", fakedarknetBin, "./fakedarknet")
+	build.Stdout = os.Stderr
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error building fakedarknet: %s\n", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testArgs are the options test daemons run with unless overridden. DIR
+// stands for the test directory.
+var testArgs = []string{
+	"--capture-dir=DIR/cap",
+	"--archive-dir=DIR/archive",
+	"--darknet-dir=DIR/darknet",
+	"--start-timeout=5000",
+	"--detect-timeout=1000",
+	"--detect-delay=50",
+	"--pickup=poll",
+	"--history-file=",
+	"--listen-addr=127.0.0.1:0",
+}
+
+// testDaemon is darknetd running fakedarknet in a test directory, with its
+// API served by an httptest server.
+type testDaemon struct {
+	*DarknetD
+	t       *testing.T
+	dir     string
+	server  *httptest.Server
+	stopped bool
+}
+
+// newTestDir returns a directory holding cap, archive, cap2 and archive2
+// directories and a darknet directory with fakedarknet and empty model files.
+func newTestDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, d := range []string{"cap", "archive", "cap2", "archive2", "darknet/cfg"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(fakedarknetBin, filepath.Join(dir, "darknet", "darknet")); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"cfg/coco.data", "cfg/yolov3-tiny.cfg", "yolov3-tiny.weights"} {
+		writeFile(t, filepath.Join(dir, "darknet", f), "")
+	}
+	return dir
+}
+
+// testConfig parses testArgs overridden by args, with DIR replaced by dir.
+func testConfig(dir string, args ...string) (DarknetDConfig, error) {
+	argv := []string{}
+	for _, a := range testArgs {
+		if !hasOption(args, a) {
+			argv = append(argv, a)
+		}
+	}
+	argv = append(argv, args...)
+	for i := range argv {
+		argv[i] = strings.Replace(argv[i], "DIR", dir, -1)
+	}
+	return getConfig(argv)
+}
+
+// hasOption reports whether args sets the option set by arg.
+func hasOption(args []string, arg string) bool {
+	name := strings.SplitN(arg, "=", 2)[0]
+	for _, a := range args {
+		if strings.SplitN(a, "=", 2)[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// startTestDaemon starts darknetd in dir with testArgs overridden by args and
+// waits for darknet to run. Set FAKEDARKNET_ variables with t.Setenv first to
+// script fakedarknet. The daemon is stopped when the test ends.
+func startTestDaemon(t *testing.T, dir string, args ...string) *testDaemon {
+	t.Helper()
+	c, err := testConfig(dir, args...)
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+	dd := newDarknetD(c, prometheus.NewRegistry())
+	if err := dd.start(); err != nil {
+		t.Fatal(err)
+	}
+	td := &testDaemon{DarknetD: dd, t: t, dir: dir, server: httptest.NewServer(dd.router())}
+	t.Cleanup(td.stop)
+	waitFor(t, "darknet to start", func() bool { return dd.getState().status == DARKNET_RUNNING })
+	for _, cam := range dd.cameras {
+		// images captured before the first scan are skipped as old
+		if cam.watcher == nil {
+			waitFor(t, "camera "+cam.Name+" to be scanned", cam.queue.hasScanned)
+		}
+	}
+	return td
+}
+
+func (q *imageQueue) hasScanned() bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.scanned
+}
+
+func (td *testDaemon) stop() {
+	if td.stopped {
+		return
+	}
+	td.stopped = true
+	td.server.Close()
+	td.DarknetD.stop()
+}
+
+// waitFor polls cond until it holds, failing the test after 10 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeJPEG returns data that passes for a complete JPEG, but can't be decoded.
+func fakeJPEG(name string) string {
+	return "\xff\xd8\xff\xe0fake jpeg " + name + "\xff\xd9"
+}
+
+// capture drops a fake JPEG called name into dir, as raspistill would.
+func capture(t *testing.T, dir, name string) {
+	t.Helper()
+	writeFile(t, filepath.Join(dir, name), fakeJPEG(name))
+}
+
+// capture drops a fake JPEG into the default camera's archive.
+func (td *testDaemon) capture(name string) {
+	td.t.Helper()
+	capture(td.t, filepath.Join(td.dir, "archive"), name)
+}
+
+// timelapse captures a new image every 100ms, as raspistill -tl would, until
+// the returned function is called, so each fixture output gets detected.
+func (td *testDaemon) timelapse() func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 1; ; n++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			name := fmt.Sprintf("frame%d.jpg", n)
+			ioutil.WriteFile(filepath.Join(td.dir, "archive", name), []byte(fakeJPEG(name)), 0644)
+		}
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+	td.t.Cleanup(stop)
+	return stop
+}
+
+// do sends a request to the API, returning the status and body.
+func (td *testDaemon) do(method, path, contentType, body string) (int, string) {
+	td.t.Helper()
+	req, err := http.NewRequest(method, td.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func (td *testDaemon) get(path string) (int, string) {
+	td.t.Helper()
+	return td.do("GET", path, "", "")
+}
+
+// getJSON decodes the JSON returned by GET path into v, failing the test
+// unless it is returned with 200 OK.
+func (td *testDaemon) getJSON(path string, v interface{}) {
+	td.t.Helper()
+	status, body := td.get(path)
+	if status != http.StatusOK {
+		td.t.Fatalf("GET %s: %d %s", path, status, body)
+	}
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		td.t.Fatalf("GET %s: %s: %s", path, err, body)
+	}
+}
+
+// objects returns the recent detections from GET /objects with query.
+func (td *testDaemon) objects(query string) []DarknetResult {
+	td.t.Helper()
+	results := []DarknetResult{}
+	td.getJSON("/objects"+query, &results)
+	return results
+}
+
+// waitForImage waits for the named image to be detected, returning its result.
+func (td *testDaemon) waitForImage(path, image string) DarknetResult {
+	td.t.Helper()
+	var found DarknetResult
+	waitFor(td.t, image+" to be detected", func() bool {
+		results := []DarknetResult{}
+		td.getJSON(path, &results)
+		var ok bool
+		found, ok = findImage(results, image)
+		return ok
+	})
+	return found
+}
+
+// detections returns the number of detections of the camera by model.
+func (td *testDaemon) detections(camera, model string) int {
+	return int(testutil.ToFloat64(td.metrics.Detections.WithLabelValues(camera, model)))
+}
+
+func findImage(results []DarknetResult, image string) (DarknetResult, bool) {
+	for _, lr := range results {
+		if lr.Image == image {
+			return lr, true
+		}
+	}
+	return DarknetResult{}, false
+}
+
+// hasObject reports whether results hold an object of class.
+func hasObject(results []DarknetResult, class string) bool {
+	for _, lr := range results {
+		for _, o := range lr.Objects {
+			if o.Class == class {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fixture returns the path of a fakedarknet fixture.
+func fixture(name string) string {
+	return filepath.Join(fixturesDir, name+".txt")
+}
+
+func TestDetections(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	td := startTestDaemon(t, newTestDir(t))
+
+	td.capture("image1.jpg")
+	lr := td.waitForImage("/objects", "image1.jpg")
+	want := []Object{{Class: "person", Prob: 85, Left: 365, Right: 445, Top: 314, Bot: 413, Model: "yolov3-tiny"}}
+	if !reflect.DeepEqual(lr.Objects, want) {
+		t.Errorf("Unexpected objects %+v", lr.Objects)
+	}
+	if lr.Camera != "default" || lr.Model != "yolov3-tiny" || lr.TimeDetect != 0.767813 || lr.PredImage != "predictions_image1.jpg" {
+		t.Errorf("Unexpected result %+v", lr)
+	}
+	status, pred := td.get("/image/predictions_image1.jpg")
+	if status != http.StatusOK || pred != fakeJPEG("image1.jpg") {
+		t.Errorf("/image/predictions_image1.jpg: %d %q", status, pred)
+	}
+	if _, err := os.Lstat(filepath.Join(td.dir, "cap", detectFilename)); !os.IsNotExist(err) {
+		t.Errorf("%s left in the capture dir", detectFilename)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if n := td.detections("default", "yolov3-tiny"); n != 1 {
+		t.Errorf("image1.jpg detected %d times", n)
+	}
+	td.capture("image2.jpg")
+	lr = td.waitForImage("/objects", "image2.jpg")
+	if !hasObject([]DarknetResult{lr}, "dog") {
+		t.Errorf("No dog in %+v", lr.Objects)
+	}
+	if n := td.detections("default", "yolov3-tiny"); n != 2 {
+		t.Errorf("Expected 2 detections, got %d", n)
+	}
+}
+
+func TestStopWaitsForDarknet(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t))
+	td.capture("image1.jpg")
+	td.waitForImage("/objects", "image1.jpg")
+	td.stop()
+	if s := td.getState().status; s != DARKNET_STOPPED {
+		t.Errorf("Darknet %s after stop", s)
+	}
+	if td.detector != nil {
+		t.Errorf("Detector left running after stop")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+// Detector runs object detection on image files. A Detector is started once
+// and closed once; the supervisor builds a fresh one for every (re)start via
+// DarknetD.newDetector. Calls are serialized by DarknetD.cmdmtx.
+type Detector interface {
+	// Start launches the backend and blocks until it is ready to detect.
+	Start() error
+	// Detect runs detection on the image at imgPath. If the backend produces an
+	// annotated image it is written to predPath, unless predPath is empty.
+	// Errors caused by the backend are returned as a detectorError, fatal if
+	// they leave it unusable.
+	Detect(imgPath, predPath string) (DarknetResult, error)
+	// Done is closed when the backend exits on its own.
+	Done() <-chan struct{}
+	// Err explains why Done was closed.
+	Err() error
+	// Close stops the backend and releases its resources.
+	Close() error
+}
+
+// detectorError marks job errors caused by the detector itself, as opposed to
+// a missing image or a full disk. Fatal errors mean the detector must be restarted.
+type detectorError struct {
+	err   error
+	fatal bool
+}
+
+func (e detectorError) Error() string {
+	return e.err.Error()
+}
@@ -0,0 +1,66 @@
+#!/bin/sh
+# e2e.sh is a smoke test of the darknetd binary: it builds darknetd and
+# fakedarknet, starts darknetd, and checks that a captured image is detected.
+# The go tests cover the rest.
+#
+# Usage: sh fakedarknet/e2e.sh    (or: make e2e)
+set -eu
+
+ROOT=$(cd "$(dirname "$0")/.." && pwd)
+WORK=$(mktemp -d)
+ADDR=127.0.0.1:${E2E_PORT:-18081}
+PID=
+
+cleanup() {
+	[ -n "$PID" ] && kill "$PID" 2>/dev/null || true
+	rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+fail() {
+	echo "FAIL: $*"
+	echo "--- darknetd log:"
+	cat "$WORK/darknetd.log"
+	exit 1
+}
+
+# waitfor retries a shell condition for up to 30 seconds.
+waitfor() {
+	for i in $(seq 1 60); do
+		if eval "$1"; then
+			return 0
+		fi
+		sleep 0.5
+	done
+	fail "timed out waiting for: $1"
+}
+
+get() {
+	curl -s "http://$ADDR$1"
+}
+
+echo "building darknetd and fakedarknet"
+mkdir -p "$WORK/darknet/cfg" "$WORK/cap" "$WORK/archive"
+touch "$WORK/darknet/cfg/coco.data" "$WORK/darknet/cfg/yolov3-tiny.cfg" "$WORK/darknet/yolov3-tiny.weights"
+(cd "$ROOT" && go build -o "$WORK/darknetd" .)
+(cd "$ROOT" && go build -o "$WORK/darknet/darknet" ./fakedarknet)
+
+echo "detections"
+FAKEDARKNET_FIXTURE="$ROOT/fakedarknet/fixtures/nnpack.txt" "$WORK/darknetd" \
+	--capture-dir="$WORK/cap" \
+	--archive-dir="$WORK/archive" \
+	--darknet-dir="$WORK/darknet" \
+	--history-file="$WORK/history.db" \
+	--listen-addr="$ADDR" >"$WORK/darknetd.log" 2>&1 &
+PID=$!
+waitfor '[ "$(get /health)" = OK ]'
+printf '\377\330\377\340fake jpeg\377\331' >"$WORK/archive/image1.jpg"
+waitfor 'get /objects | grep -q "\"Image\":\"image1.jpg\""'
+get /objects | grep -q '"Class":"person"' || fail "/objects missing person"
+get /detections | grep -q '"Image":"image1.jpg"' || fail "/detections missing image1.jpg"
+get /metrics | grep -q '^darknetd_detections{camera="default",model="yolov3-tiny"} [1-9]' || fail "darknetd_detections not counted"
+kill "$PID"
+wait "$PID" 2>/dev/null || true
+PID=
+
+echo "PASS"
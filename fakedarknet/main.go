@@ -0,0 +1,140 @@
+// fakedarknet stands in for a patched `darknet detector test` binary, so
+// darknetd can be exercised without a real model. It speaks the same stdin
+// protocol: print a prompt, read an image path, print timing and CLASS/BBOX
+// lines, write predictions.jpg to the working directory, prompt again.
+//
+// Behavior is controlled through the environment, which darknetd passes on to
+// its child process:
+//
+//	FAKEDARKNET_MODE         normal, slow, crash or garbage [default: normal]
+//	FAKEDARKNET_FIXTURE      file of scripted outputs, separated by "---" lines
+//	FAKEDARKNET_BANNER       file printed to stdout at startup, before the first prompt
+//	FAKEDARKNET_DELAY        per-detection delay, e.g. 200ms; slow mode defaults to 1m
+//	FAKEDARKNET_START_DELAY  delay before the first prompt, simulating model load
+//	FAKEDARKNET_CRASH_AFTER  detections to answer before exiting in crash mode [default: 0]
+//
+// Fixture outputs are Printf formats, so may use %[1]s for the image path and
+// must escape literal percent signs as %%. They are replayed in order,
+// wrapping around at the end. As with stock AlexeyAB builds, -ext_output
+// bounding boxes are only printed when run with -ext_output.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const prompt = "Enter Image Path: "
+
+// extOutputBBox is the bounding box stock AlexeyAB builds only print with
+// -ext_output.
+var extOutputBBox = regexp.MustCompile(`(?m)\t\(left_x:.*\)$`)
+
+var defaultFixture = []string{
+	"%[1]s: Predicted in 0.767813 seconds.\nCLASS\tperson\t85\tBBOX\t365 445 314 413\n",
+	"%[1]s: Predicted in 812.5 milli-seconds.\nCLASS\tcar\t64\tBBOX\t12 200 40 180\nCLASS\tperson\t91\tBBOX\t300 360 100 290\n",
+	"%[1]s: Predicted in 0.702115 seconds.\n",
+}
+
+func main() {
+	mode := getenv("FAKEDARKNET_MODE", "normal")
+	fixture, err := loadFixture(os.Getenv("FAKEDARKNET_FIXTURE"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fakedarknet: %s\n", err)
+		os.Exit(2)
+	}
+	delay := getDuration("FAKEDARKNET_DELAY", 0)
+	if mode == "slow" {
+		delay = getDuration("FAKEDARKNET_DELAY", time.Minute)
+	}
+	crashAfter, _ := strconv.Atoi(getenv("FAKEDARKNET_CRASH_AFTER", "0"))
+
+	extOutput := false
+	for _, arg := range os.Args[1:] {
+		extOutput = extOutput || arg == "-ext_output"
+	}
+
+	fmt.Fprintf(os.Stderr, "fakedarknet: %s mode, args %v\n", mode, os.Args[1:])
+	time.Sleep(getDuration("FAKEDARKNET_START_DELAY", 0))
+	if banner := os.Getenv("FAKEDARKNET_BANNER"); banner != "" {
+		data, err := ioutil.ReadFile(banner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fakedarknet: %s\n", err)
+			os.Exit(2)
+		}
+		os.Stdout.Write(data)
+	}
+	fmt.Print(prompt)
+
+	stdin := bufio.NewScanner(os.Stdin)
+	for n := 0; stdin.Scan(); n++ {
+		imgPath := strings.TrimSpace(stdin.Text())
+		if mode == "crash" && n >= crashAfter {
+			fmt.Fprintf(os.Stderr, "fakedarknet: crashing on %s\n", imgPath)
+			os.Exit(1)
+		}
+		time.Sleep(delay)
+		if mode == "garbage" {
+			fmt.Printf("%s: Predicted in soon seconds.\nCLASS\tperson\tmaybe\tBBOX\tleft right\n\x00\x01 garbage\n", imgPath)
+		} else {
+			output := fmt.Sprintf(fixture[n%len(fixture)], imgPath)
+			if !extOutput {
+				output = extOutputBBox.ReplaceAllString(output, "")
+			}
+			fmt.Print(output)
+		}
+		if err := copyFile(imgPath, "predictions.jpg"); err != nil {
+			fmt.Fprintf(os.Stderr, "fakedarknet: %s\n", err)
+		}
+		fmt.Print(prompt)
+	}
+}
+
+func loadFixture(path string) ([]string, error) {
+	if path == "" {
+		return defaultFixture, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	outputs := []string{}
+	for _, o := range strings.Split(string(data), "---\n") {
+		if strings.TrimSpace(o) != "" {
+			outputs = append(outputs, o)
+		}
+	}
+	if len(outputs) < 1 {
+		return nil, fmt.Errorf("no outputs in fixture %s", path)
+	}
+	return outputs, nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0644)
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
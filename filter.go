@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resultFilter selects results by camera, objects by class, zone and minimum
+// probability, and optionally skips results with no objects. The zero value
+// matches everything.
+type resultFilter struct {
+	camera   string
+	classes  map[string]bool
+	zone     string
+	minProb  int
+	nonEmpty bool
+}
+
+// parseResultFilter reads the camera=front, class=person,car, zone=driveway,
+// minprob=60 and nonempty=true query parameters.
+func parseResultFilter(q url.Values) (resultFilter, error) {
+	f := resultFilter{camera: q.Get("camera")}
+	if v := q.Get("class"); v != "" {
+		f.classes = map[string]bool{}
+		for _, c := range strings.Split(v, ",") {
+			f.classes[strings.TrimSpace(c)] = true
+		}
+	}
+	f.zone = q.Get("zone")
+	if v := q.Get("minprob"); v != "" {
+		var err error
+		f.minProb, err = strconv.Atoi(v)
+		if err != nil || f.minProb < 0 || f.minProb > 100 {
+			return f, fmt.Errorf("Invalid minprob: %s", v)
+		}
+	}
+	if v := q.Get("nonempty"); v != "" {
+		var err error
+		if f.nonEmpty, err = strconv.ParseBool(v); err != nil {
+			return f, fmt.Errorf("Invalid nonempty: %s", v)
+		}
+	}
+	return f, nil
+}
+
+func (f resultFilter) active() bool {
+	return f.classes != nil || f.zone != "" || f.minProb > 0
+}
+
+func (f resultFilter) match(o Object) bool {
+	if f.classes != nil && !f.classes[o.Class] {
+		return false
+	}
+	if f.zone != "" && !inZone(o, f.zone) {
+		return false
+	}
+	return o.Prob >= f.minProb
+}
+
+func inZone(o Object, zone string) bool {
+	for _, z := range o.Zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// apply drops non-matching objects from lr. When the filter is active, results
+// left with no objects are rejected.
+func (f resultFilter) apply(lr DarknetResult) (DarknetResult, bool) {
+	if f.camera != "" && lr.Camera != f.camera {
+		return lr, false
+	}
+	if !f.active() {
+		return lr, !f.nonEmpty || len(lr.Objects) > 0
+	}
+	objects := []Object{}
+	for _, o := range lr.Objects {
+		if f.match(o) {
+			objects = append(objects, o)
+		}
+	}
+	lr.Objects = objects
+	return lr, len(objects) > 0
+}
+
+// parseTimeParam reads an RFC3339 timestamp from q, or returns def if unset.
+func parseTimeParam(q url.Values, name string, def time.Time) (time.Time, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("Invalid %s: %s", name, v)
+	}
+	return t, nil
+}
+
+// parseLimitParam reads the limit query parameter, capped at max.
+func parseLimitParam(q url.Values, max int) (int, error) {
+	v := q.Get("limit")
+	if v == "" {
+		return max, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("Invalid limit: %s", v)
+	}
+	if limit > max {
+		limit = max
+	}
+	return limit, nil
+}
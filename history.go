@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var historyBucket = []byte("detections")
+
+// History is an on-disk log of every DarknetResult, keyed by ID. IDs are
+// assigned in detection order, no earlier than PredTime in nanoseconds, so
+// time ranges start from the key of their start time.
+type History struct {
+	db *bolt.DB
+}
+
+func openHistory(path string) (*History, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &History{db: db}, nil
+}
+
+func (h *History) Close() error {
+	return h.db.Close()
+}
+
+func historyKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+func (h *History) Add(lr DarknetResult) error {
+	v, err := json.Marshal(lr)
+	if err != nil {
+		return err
+	}
+	return h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).Put(historyKey(lr.ID), v)
+	})
+}
+
+// Query returns up to limit results with from <= PredTime < to, oldest first,
+// passed through filter.
+func (h *History) Query(from, to time.Time, filter resultFilter, limit int) ([]DarknetResult, error) {
+	results := []DarknetResult{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.Seek(historyKey(uint64(from.UnixNano()))); k != nil; k, v = c.Next() {
+			lr := DarknetResult{}
+			if err := json.Unmarshal(v, &lr); err != nil {
+				return err
+			}
+			if lr.PredTime.Before(from) {
+				continue
+			}
+			if !lr.PredTime.Before(to) {
+				break
+			}
+			lr, ok := filter.apply(lr)
+			if !ok {
+				continue
+			}
+			results = append(results, lr)
+			if len(results) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+// Cleanup deletes results older than before and returns how many were removed.
+func (h *History) Cleanup(before time.Time) (int, error) {
+	n := 0
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		c := b.Cursor()
+		old := [][]byte{}
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			lr := DarknetResult{}
+			if err := json.Unmarshal(v, &lr); err != nil {
+				return err
+			}
+			if !lr.PredTime.Before(before) {
+				break
+			}
+			old = append(old, k)
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	return n, err
+}
+
+func startHistoryManager(history *History, retention func() time.Duration, cleanedUp prometheus.Counter, historyErrors *prometheus.CounterVec, quit <-chan struct{}) error {
+	go func() {
+		cleanTick := time.NewTicker(time.Minute * 10)
+		defer cleanTick.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-cleanTick.C:
+				n, err := history.Cleanup(time.Now().Add(-retention()))
+				if err != nil {
+					historyErrors.WithLabelValues("Cleanup").Add(1)
+					log.Printf("History cleanup error: %s", err)
+					break
+				}
+				cleanedUp.Add(float64(n))
+			}
+		}
+	}()
+	return nil
+}
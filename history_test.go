@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistorySurvivesRestart(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	dir := newTestDir(t)
+	td := startTestDaemon(t, dir, "--history-file=DIR/history.db")
+	td.capture("image1.jpg")
+	td.waitForImage("/detections", "image1.jpg")
+	td.capture("image2.jpg")
+	td.waitForImage("/detections", "image2.jpg")
+	td.stop()
+
+	td = startTestDaemon(t, dir, "--history-file=DIR/history.db")
+	results := []DarknetResult{}
+	td.getJSON("/detections", &results)
+	for _, image := range []string{"image1.jpg", "image2.jpg"} {
+		if _, ok := findImage(results, image); !ok {
+			t.Errorf("/detections lost %s", image)
+		}
+	}
+	results = []DarknetResult{}
+	td.getJSON("/detections?class=dog&minprob=50", &results)
+	if len(results) != 1 || len(results[0].Objects) != 1 || results[0].Objects[0].Class != "dog" {
+		t.Errorf("/detections class filter returned %+v", results)
+	}
+	results = []DarknetResult{}
+	td.getJSON("/detections?to=2001-01-01T00:00:00Z", &results)
+	if len(results) != 0 {
+		t.Errorf("/detections time range returned %+v", results)
+	}
+	for _, query := range []string{"?from=yesterday", "?limit=x", "?minprob=101"} {
+		if status, _ := td.get("/detections" + query); status != http.StatusBadRequest {
+			t.Errorf("/detections%s: %d", query, status)
+		}
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t))
+	if status, _ := td.get("/detections"); status != http.StatusNotFound {
+		t.Errorf("/detections without history: %d", status)
+	}
+}
+
+func TestHistoryDirCreated(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t), "--history-file=DIR/state/darknetd/history.db")
+	if td.history == nil {
+		t.Errorf("History not opened")
+	}
+}
+
+func TestHistorySameTime(t *testing.T) {
+	h, err := openHistory(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	now := time.Now()
+	for id, image := range []string{"front.jpg", "back.jpg"} {
+		lr := DarknetResult{ID: uint64(now.UnixNano()) + uint64(id), PredTime: now, Image: image}
+		if err := h.Add(lr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := h.Query(now.Add(-time.Minute), now.Add(time.Minute), resultFilter{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Image != "front.jpg" || results[1].Image != "back.jpg" {
+		t.Errorf("Query returned %+v", results)
+	}
+	if n, err := h.Cleanup(now.Add(time.Minute)); n != 2 || err != nil {
+		t.Errorf("Cleanup removed %d: %v", n, err)
+	}
+}
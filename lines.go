@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Line is a named tripwire from Points[0] to Points[1], in pixels or, when
+// Normalized, fractions of the frame size. Tracked objects crossing it from
+// its left to its right, as seen on screen looking from the first point to
+// the second, count as "in"; the other way as "out". Anchor selects the bbox
+// point that must cross, as for zones.
+type Line struct {
+	Name       string
+	Points     [2][2]float64
+	Normalized bool
+	Anchor     string
+}
+
+// LineCrossing reports a tracked object crossing a line.
+type LineCrossing struct {
+	Line      string
+	Class     string
+	Direction string
+	TrackID   uint64
+}
+
+// LineCounts is the number of crossings of a line in each direction.
+type LineCounts struct {
+	In  int
+	Out int
+}
+
+// Lines counts tracked objects crossing lines.
+type Lines struct {
+	lines      []Line
+	archiveDir string
+	counts     map[string]map[string]*LineCounts // line -> class -> crossings
+	mtx        sync.Mutex
+
+	crossings *prometheus.CounterVec
+}
+
+// loadLines reads a JSON array of Line from path.
+func loadLines(path string) ([]Line, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLines(data, path)
+}
+
+// decodeLines decodes a JSON array of Line, read from source.
+func decodeLines(data []byte, source string) ([]Line, error) {
+	lines := []Line{}
+	if err := json.Unmarshal(data, &lines); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", source, err)
+	}
+	if err := validateLines(lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func validateLines(lines []Line) error {
+	names := map[string]bool{}
+	for i, l := range lines {
+		if l.Name == "" {
+			return fmt.Errorf("Invalid line %d: Name is required", i)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("Invalid line %s: duplicate Name", l.Name)
+		}
+		names[l.Name] = true
+		if l.Points[0] == l.Points[1] {
+			return fmt.Errorf("Invalid line %s: 2 distinct Points are required", l.Name)
+		}
+		switch l.Anchor {
+		case "", "bottom", "center":
+		default:
+			return fmt.Errorf("Invalid line %s: Anchor must be bottom or center", l.Name)
+		}
+		if l.Normalized {
+			for _, p := range l.Points {
+				if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+					return fmt.Errorf("Invalid line %s: normalized Points must be between 0 and 1", l.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func newLines(lines []Line, archiveDir string, crossings *prometheus.CounterVec) *Lines {
+	counts := map[string]map[string]*LineCounts{}
+	for _, l := range lines {
+		counts[l.Name] = map[string]*LineCounts{}
+	}
+	return &Lines{
+		lines:      lines,
+		archiveDir: archiveDir,
+		counts:     counts,
+		crossings:  crossings,
+	}
+}
+
+// enabled reports whether any lines are configured.
+func (ls *Lines) enabled() bool {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	return len(ls.lines) > 0
+}
+
+// set replaces the lines, e.g. on reload. Counts of lines that are kept carry
+// over.
+func (ls *Lines) set(lines []Line) {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	counts := map[string]map[string]*LineCounts{}
+	for _, l := range lines {
+		if c, ok := ls.counts[l.Name]; ok {
+			counts[l.Name] = c
+		} else {
+			counts[l.Name] = map[string]*LineCounts{}
+		}
+	}
+	ls.lines = lines
+	ls.counts = counts
+}
+
+// apply counts the moved tracks, as returned by Tracker.apply, that crossed a
+// line between their previous and current positions, and adds the crossings
+// to lr.
+func (ls *Lines) apply(lr *DarknetResult, moved []Track) {
+	if len(moved) == 0 {
+		return
+	}
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	width, height := 0.0, 0.0
+	for _, l := range ls.lines {
+		if l.Normalized {
+			b := imageBounds(filepath.Join(ls.archiveDir, lr.Image))
+			width, height = float64(b.Dx()), float64(b.Dy())
+			break
+		}
+	}
+
+	for _, l := range ls.lines {
+		a, b := l.Points[0], l.Points[1]
+		if l.Normalized {
+			if width == 0 || height == 0 {
+				log.Printf("Line %s: unknown size of %s, skipping", l.Name, lr.Image)
+				continue
+			}
+			a = [2]float64{a[0] * width, a[1] * height}
+			b = [2]float64{b[0] * width, b[1] * height}
+		}
+		for _, tr := range moved {
+			px, py := anchorPoint(*tr.prev, l.Anchor)
+			qx, qy := anchorPoint(tr.Object, l.Anchor)
+			direction := lineCrossing(a, b, [2]float64{px, py}, [2]float64{qx, qy})
+			if direction == "" {
+				continue
+			}
+			c, ok := ls.counts[l.Name][tr.Class]
+			if !ok {
+				c = &LineCounts{}
+				ls.counts[l.Name][tr.Class] = c
+			}
+			if direction == "in" {
+				c.In++
+			} else {
+				c.Out++
+			}
+			lr.LineCrossings = append(lr.LineCrossings, LineCrossing{Line: l.Name, Class: tr.Class, Direction: direction, TrackID: tr.ID})
+			ls.crossings.WithLabelValues(l.Name, tr.Class, direction).Add(1)
+		}
+	}
+}
+
+// Counts returns the crossings of each line by class since startup.
+func (ls *Lines) Counts() map[string]map[string]LineCounts {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	counts := map[string]map[string]LineCounts{}
+	for line, classes := range ls.counts {
+		counts[line] = map[string]LineCounts{}
+		for class, c := range classes {
+			counts[line][class] = *c
+		}
+	}
+	return counts
+}
+
+// lineCrossing returns "in" if the movement p->q crosses the segment a->b from
+// its left to its right (in image coordinates, y down), "out" if the other
+// way, or "" if it doesn't cross. Landing exactly on the line counts as being
+// on its right, so an object stopping on the line is counted once.
+func lineCrossing(a, b, p, q [2]float64) string {
+	sp, sq := side(a, b, p), side(a, b, q)
+	if (sp >= 0) == (sq >= 0) {
+		return ""
+	}
+	// a and b must also be on opposite sides of p->q
+	if side(p, q, a)*side(p, q, b) > 0 {
+		return ""
+	}
+	if sq >= 0 {
+		return "in"
+	}
+	return "out"
+}
+
+// side is positive when p is right of a->b as seen on screen, negative when left.
+func side(a, b, p [2]float64) float64 {
+	return (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLineCounters(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	dir := newTestDir(t)
+	// between the bottoms of the nnpack fixture's person, 413 then 415
+	writeFile(t, filepath.Join(dir, "lines.json"), `[{"Name": "door", "Points": [[300, 414], [500, 414]]}]`)
+	td := startTestDaemon(t, dir, "--lines-file=DIR/lines.json")
+	td.timelapse()
+
+	waitFor(t, "the person to cross the door both ways", func() bool {
+		counts := map[string]map[string]LineCounts{}
+		td.getJSON("/counters", &counts)
+		c := counts["door"]["person"]
+		return c.In > 0 && c.Out > 0
+	})
+	crossed := false
+	for _, lr := range td.objects("") {
+		for _, lc := range lr.LineCrossings {
+			if lc.Line != "door" || lc.Class != "person" || lc.TrackID == 0 {
+				t.Errorf("Unexpected line crossing %+v", lc)
+			}
+			crossed = true
+		}
+	}
+	if !crossed {
+		t.Errorf("No LineCrossings in /objects")
+	}
+	for _, direction := range []string{"in", "out"} {
+		if n := testutil.ToFloat64(td.metrics.LineCrossings.WithLabelValues("default", "door", "person", direction)); n < 1 {
+			t.Errorf("Line crossings %s not counted", direction)
+		}
+	}
+}
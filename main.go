@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -12,65 +15,106 @@ var usage = `darknetd: run darknet as a service, with a REST API
 
 Usage:
   darknetd [options]
+  darknetd config check [options]
   darknetd -h --help
   darknetd --version
 
 Options:
+  --config=<file>             YAML config file, overridden by options on the command line [default: ]
   --capture-dir=<path>        Directory containing captured image - see raspiconfig.service [default: /tmp/]
   --capture-file=<file>       Filename of captured image - see raspiconfig.service [default: cap.jpg]
+  --capture-url=<url>         MJPEG stream or JPEG snapshot URL of an IP camera to pull frames from, empty to use a capture tool [default: ]
+  --capture-interval=<msec>   Delay between frames pulled from capture-url in msec [default: 500]
   --archive-dir=<path>        Directory containing image archive - see raspiconfig.service [default: /tmp/cap]
   --archive-files=<file>      Number of images to retain in archive [default: 240]
+  --cameras-file=<file>       JSON file of camera sources, replacing the capture & archive options, empty for one camera [default: ]
   --darknet-dir=<path>        Directory containing darknet installation [default: /usr/local/darknet]
   --darknet-data=<file>       Darknet data file, relative to darknet-dir [default: cfg/coco.data]
   --model-config=<file>       Darknet model config file, relative to darknet-dir [default: cfg/yolov3-tiny.cfg]
   --model-weights=<file>      Darknet model weights file, relative to darknet-dir [default: yolov3-tiny.weights]
+  --models-file=<file>        JSON file of models to run on every image, replacing the model options, empty for one model [default: ]
+  --models-parallel           Run the models on each image in parallel rather than in sequence
+  --darknet-flavor=<name>     Darknet fork output format: auto, pjreddie, nnpack or alexeyab [default: auto]
   --start-timeout=<msec>      Darknet startup & model load timeout in msec [default: 30000]
   --detect-timeout=<msec>     Darknet detection timeout in msec [default: 10000]
   --detect-delay=<msec>       Darknet delay between detections in msec [default: 500]
+  --pickup=<mode>             Pick up new images by watching the archive, or polling it every detect-delay: watch or poll [default: watch]
+  --backlog=<policy>          Images to detect when they arrive faster than detection: latest-only, all or sample-every-N [default: latest-only]
+  --motion-threshold=<ratio>  Fraction of the frame that must change to run detection, 0 to detect every frame [default: 0]
+  --motion-heartbeat=<msec>   Run detection this often in msec even without motion, 0 to never [default: 10000]
+  --motion-mask=<file>        JPEG or PNG mask, black where motion is ignored, empty for none [default: ]
+  --ingest-max-bytes=<bytes>  Largest image accepted by /ingest [default: 10485760]
+  --ingest-rate=<per-sec>     Images per second accepted by /ingest from each client, 0 for no limit [default: 5]
+  --history-file=<file>       Detection history database, empty to disable [default: /var/lib/darknetd/history.db]
+  --history-days=<days>       Days of detection history to retain [default: 30]
+  --track-iou=<ratio>         Minimum bbox overlap to follow an object between detections, 0 to disable tracking [default: 0.3]
+  --track-max-age=<msec>      End tracks unseen for this long in msec [default: 5000]
+  --lines-file=<file>         JSON file of tripwire lines to count tracked objects crossing, empty to disable [default: ]
+  --zones-file=<file>         JSON file of polygon detection zones, empty to disable [default: ]
+  --webhooks-file=<file>      JSON file of webhook notification rules, empty to disable [default: ]
+  --mqtt-broker=<url>         MQTT broker to publish detections to, e.g. tcp://localhost:1883, empty to disable [default: ]
+  --mqtt-username=<user>      MQTT username [default: ]
+  --mqtt-password=<pass>      MQTT password [default: ]
+  --mqtt-topic=<prefix>       MQTT topic prefix [default: darknetd]
+  --mqtt-qos=<qos>            MQTT QoS: 0, 1 or 2 [default: 0]
+  --mqtt-retain               Retain the last detection and per-class state on the broker
+  --mqtt-discovery=<prefix>   Home Assistant MQTT discovery prefix, empty to disable [default: homeassistant]
   --listen-addr=<addr:port>   API listen address:port [default: 0.0.0.0:8081]
   --version                   Show version
   -h, --help                  Show this screen
 `
 
 const (
-	detectFilename      = "detect.jpg"
-	darknetRestartDelay = time.Second * 5
+	detectFilename         = "detect.jpg"
+	darknetRestartDelay    = time.Second * 5
+	darknetMaxRestartDelay = time.Minute * 5
+	darknetStableTime      = time.Minute
+	darknetStopTimeout     = time.Second * 5
+	darknetMaxJobErrors    = 5
+	archiveCleanupInterval = time.Second * 10
+	darknetBannerLines     = 200
+	maxUploadBytes         = 20 << 20
+	historyMaxResults      = 10000
+	streamBufferSize       = 16
+	streamHeartbeat        = time.Second * 15
+	streamWriteTimeout     = time.Second * 10
+	webhookQueueSize       = 16
+	webhookTimeout         = time.Second * 10
+	webhookRetryDelay      = time.Second * 2
+	webhookMaxAttempts     = 5
+	mqttTimeout            = time.Second * 5
+	trackMinHits           = 2
+	watchSettleTime        = time.Millisecond * 100
+	watchMaxWriteTime      = time.Second * 10
+	queueMaxImages         = 1000
+	cameraRecentResults    = 10
+	sourceRetryDelay       = time.Second
+	sourceMaxRetryDelay    = time.Minute
+	sourceReadTimeout      = time.Second * 10
+	sourceMaxFrameSize     = 10 << 20
+	ingestMaxClients       = 1024
+	motionGridWidth        = 64
+	motionGridHeight       = 48
+	motionPixelDiff        = 25
+	motionRatioWindow      = 100
 )
 
 func main() {
-	log.Printf("Starting darknet")
-	darknetConfig, err := getConfig()
+	darknetConfig, err := getConfig(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
-	var dd DarknetD
-	darknetStatus := DARKNET_STOPPED // TODO: restart darknet upon process/IO failure
-	for darknetStatus != DARKNET_RUNNING {
-		dd, err = startDarknet(darknetConfig)
-		if err != nil {
-			log.Printf("Error starting darknet, trying again in %v: %s", darknetRestartDelay, err)
-			time.Sleep(darknetRestartDelay)
-			continue
-		}
-		darknetStatus = DARKNET_RUNNING
-	}
-	defer func() {
-		dd.cmdout.Close()
-		dd.cmdin.Close()
-	}()
-	log.Printf("Started darknet process")
-
-	if err := startArchiveManager(
-		dd.config.archiveDir,
-		dd.config.archiveFiles,
-		dd.metrics.CleanedUpFiles,
-		dd.metrics.CleanUpErrors,
-	); err != nil {
-		log.Fatalf("startArchiveManager error %v", err)
+	if darknetConfig.configCheck {
+		fmt.Println("Config OK")
+		return
 	}
-	if err := dd.startJobsManager(); err != nil {
-		log.Fatalf("startJobsManager error %v", err)
+	log.Printf("Starting darknet")
+	dd := newDarknetD(darknetConfig, prometheus.DefaultRegisterer)
+	if err := dd.start(); err != nil {
+		log.Fatal(err)
 	}
+	defer dd.stop()
+	dd.reloadOnSignal()
 
 	log.Printf("Starting API on %s", dd.config.listenAddr)
 	if err := dd.startAPI(dd.config.listenAddr); err != nil {
@@ -7,15 +7,62 @@ import (
 type Metrics struct {
 	ApiRequests    *prometheus.CounterVec
 	ApiErrors      *prometheus.CounterVec
-	CleanedUpFiles prometheus.Counter
+	CleanedUpFiles *prometheus.CounterVec
 	CleanUpErrors  *prometheus.CounterVec
-	JobErrors      prometheus.Counter
-	Detections     prometheus.Counter
-	PredTime       prometheus.Histogram
-	TotalTime      prometheus.Histogram
+	JobErrors      *prometheus.CounterVec
+	Detections     *prometheus.CounterVec
+	PredTime       *prometheus.HistogramVec
+	TotalTime      *prometheus.HistogramVec
+	ModelInfo      *prometheus.GaugeVec
+
+	DarknetRestarts prometheus.Counter
+	DarknetStatus   prometheus.Gauge
+	DetectTimeouts  prometheus.Counter
+	UnknownOutput   prometheus.Counter
+
+	HistoryRecords   prometheus.Counter
+	HistoryCleanedUp prometheus.Counter
+	HistoryErrors    *prometheus.CounterVec
+
+	StreamClients *prometheus.GaugeVec
+	StreamDropped *prometheus.CounterVec
+
+	WebhookDeliveries *prometheus.CounterVec
+	WebhookRetries    *prometheus.CounterVec
+	WebhookDropped    *prometheus.CounterVec
+
+	MQTTMessages  *prometheus.CounterVec
+	MQTTConnected prometheus.Gauge
+
+	ZoneObjects *prometheus.GaugeVec
+	ZoneEvents  *prometheus.CounterVec
+
+	TracksStarted *prometheus.CounterVec
+	TracksEnded   *prometheus.CounterVec
+	TracksActive  *prometheus.GaugeVec
+	TrackDwell    *prometheus.HistogramVec
+
+	LineCrossings *prometheus.CounterVec
+
+	ConfigReloads *prometheus.CounterVec
+
+	WatchErrors   *prometheus.CounterVec
+	QueuedImages  *prometheus.GaugeVec
+	DroppedImages *prometheus.CounterVec
+
+	SourceFrames     *prometheus.CounterVec
+	SourceErrors     *prometheus.CounterVec
+	SourceUp         *prometheus.GaugeVec
+	SourceReconnects *prometheus.CounterVec
+
+	IngestedImages *prometheus.CounterVec
+
+	MotionFrames    *prometheus.CounterVec
+	MotionSkipRatio *prometheus.GaugeVec
 }
 
-func setupMetrics() Metrics {
+// setupMetrics creates the metrics and registers them with reg.
+func setupMetrics(reg prometheus.Registerer) Metrics {
 	m := Metrics{}
 	m.ApiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "darknetd",
@@ -31,35 +78,201 @@ func setupMetrics() Metrics {
 		Namespace: "darknetd",
 		Name:      "cleanup_errors",
 		Help:      "Image cleanup errors.",
-	}, []string{"error"})
-	m.CleanedUpFiles = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"camera", "error"})
+	m.QueuedImages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "queued_images",
+		Help:      "Images waiting for detection.",
+	}, []string{"camera"})
+	m.DroppedImages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "dropped_images",
+		Help:      "New images not detected, by backlog policy or because they left the archive first.",
+	}, []string{"camera", "reason"})
+	m.SourceFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "source_frames",
+		Help:      "Frames pulled from camera URLs into the archive.",
+	}, []string{"camera"})
+	m.IngestedImages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "ingested_images",
+		Help:      "Images pushed to /ingest.",
+	}, []string{"camera"})
+	m.MotionFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "motion_frames",
+		Help:      "Frames checked for motion, by result: motion, heartbeat, skipped or error.",
+	}, []string{"camera", "result"})
+	m.MotionSkipRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "motion_skip_ratio",
+		Help:      "Fraction of recent frames skipped for lack of motion.",
+	}, []string{"camera"})
+	m.SourceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "source_errors",
+		Help:      "Camera URL errors, and frames skipped.",
+	}, []string{"camera", "error"})
+	m.SourceUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "source_up",
+		Help:      "Whether darknetd is connected to the camera URL.",
+	}, []string{"camera"})
+	m.SourceReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "source_reconnects",
+		Help:      "Reconnects to camera URLs after errors.",
+	}, []string{"camera"})
+	m.CleanedUpFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "darknetd",
 		Name:      "cleanup_files",
 		Help:      "Image files cleaned up.",
-	})
-	m.JobErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"camera"})
+	m.JobErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "darknetd",
 		Name:      "detection_errors",
 		Help:      "Darknet detection errors.",
-	})
-	m.Detections = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"camera"})
+	m.Detections = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "darknetd",
 		Name:      "detections",
 		Help:      "Darknet successful detection jobs.",
-	})
-	m.PredTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+	}, []string{"camera", "model"})
+	m.PredTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "darknetd",
 		Name:      "prediction_sec",
-		Help:      "Darknet prediction time sec",
+		Help:      "Darknet prediction time sec, camera is empty for uploads",
 		Buckets:   []float64{.001, .025, .05, .1, .25, .5, .6, .7, .8, .9, 1, 1.5, 2},
-	})
-	m.TotalTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+	}, []string{"camera", "model"})
+	m.TotalTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "darknetd",
 		Name:      "total_sec",
-		Help:      "Total job time sec",
+		Help:      "Total job time sec, camera is empty for uploads",
 		Buckets:   []float64{.001, .025, .05, .1, .25, .5, .6, .7, .8, .9, 1, 1.5, 2},
+	}, []string{"camera", "model"})
+	m.ModelInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "model_info",
+		Help:      "The active darknet model, always 1.",
+	}, []string{"model"})
+	m.DarknetRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "darknet_restarts",
+		Help:      "Darknet process restarts.",
 	})
-	prometheus.MustRegister(
+	m.DarknetStatus = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "darknet_status",
+		Help:      "Darknet process status: 0=stopped, 1=running, 2=starting, 3=restarting.",
+	})
+	m.DetectTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "detection_timeouts",
+		Help:      "Darknet detections abandoned after --detect-timeout.",
+	})
+	m.UnknownOutput = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "unknown_output_lines",
+		Help:      "Darknet output lines not recognized by the --darknet-flavor parser.",
+	})
+	m.HistoryRecords = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "history_records",
+		Help:      "Detections written to the history database.",
+	})
+	m.HistoryCleanedUp = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "history_cleanup_records",
+		Help:      "Detections removed from the history database after --history-days.",
+	})
+	m.HistoryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "history_errors",
+		Help:      "History database errors.",
+	}, []string{"error"})
+	m.StreamClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "stream_clients",
+		Help:      "Connected streaming API clients.",
+	}, []string{"type"})
+	m.StreamDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "stream_dropped",
+		Help:      "Detections dropped for slow streaming API clients.",
+	}, []string{"type"})
+	m.WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "webhook_deliveries",
+		Help:      "Webhook notifications delivered or given up on.",
+	}, []string{"rule", "status"})
+	m.WebhookRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "webhook_retries",
+		Help:      "Webhook delivery retries.",
+	}, []string{"rule"})
+	m.WebhookDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "webhook_dropped",
+		Help:      "Webhook notifications dropped because the rule's queue was full.",
+	}, []string{"rule"})
+	m.MQTTMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "mqtt_messages",
+		Help:      "MQTT messages published, by outcome.",
+	}, []string{"status"})
+	m.WatchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "watch_errors",
+		Help:      "Archive watcher errors, and incomplete images skipped.",
+	}, []string{"camera", "error"})
+	m.MQTTConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "mqtt_connected",
+		Help:      "1 if connected to the MQTT broker.",
+	})
+	m.ZoneObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "zone_objects",
+		Help:      "Objects in each zone in the latest detection.",
+	}, []string{"camera", "zone", "class"})
+	m.ZoneEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "zone_events",
+		Help:      "Zone enter/leave events.",
+	}, []string{"camera", "zone", "class", "event"})
+	m.TracksStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "tracks_started",
+		Help:      "Object tracks started, i.e. unique objects seen.",
+	}, []string{"camera", "class"})
+	m.TracksEnded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "tracks_ended",
+		Help:      "Object tracks ended.",
+	}, []string{"camera", "class"})
+	m.TracksActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "darknetd",
+		Name:      "tracks_active",
+		Help:      "Object tracks currently active.",
+	}, []string{"camera", "class"})
+	m.TrackDwell = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "darknetd",
+		Name:      "track_dwell_sec",
+		Help:      "Time from first to last sighting of ended tracks sec",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"camera", "class"})
+	m.LineCrossings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "line_crossings",
+		Help:      "Tracked objects crossing each line, by direction.",
+	}, []string{"camera", "line", "class", "direction"})
+	m.ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "darknetd",
+		Name:      "config_reloads",
+		Help:      "Config reloads, by status.",
+	}, []string{"status"})
+	reg.MustRegister(
 		m.ApiRequests,
 		m.ApiErrors,
 		m.CleanUpErrors,
@@ -68,6 +281,39 @@ func setupMetrics() Metrics {
 		m.JobErrors,
 		m.PredTime,
 		m.TotalTime,
+		m.ModelInfo,
+		m.DarknetRestarts,
+		m.DarknetStatus,
+		m.DetectTimeouts,
+		m.UnknownOutput,
+		m.HistoryRecords,
+		m.HistoryCleanedUp,
+		m.HistoryErrors,
+		m.StreamClients,
+		m.StreamDropped,
+		m.WebhookDeliveries,
+		m.WebhookRetries,
+		m.WebhookDropped,
+		m.MQTTMessages,
+		m.MQTTConnected,
+		m.ZoneObjects,
+		m.ZoneEvents,
+		m.TracksStarted,
+		m.TracksEnded,
+		m.TracksActive,
+		m.TrackDwell,
+		m.LineCrossings,
+		m.ConfigReloads,
+		m.WatchErrors,
+		m.QueuedImages,
+		m.DroppedImages,
+		m.SourceFrames,
+		m.SourceErrors,
+		m.SourceUp,
+		m.SourceReconnects,
+		m.IngestedImages,
+		m.MotionFrames,
+		m.MotionSkipRatio,
 	)
 	return m
 }
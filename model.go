@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Model is a set of darknet data, cfg and weights files, relative to
+// --darknet-dir. Name labels results and metrics, and defaults to the weights
+// file name without extension.
+type Model struct {
+	Name    string
+	Data    string
+	Config  string
+	Weights string
+}
+
+// modelSwitch hands a started detector running models to the supervisor,
+// which closes done once detections go to it.
+type modelSwitch struct {
+	detector Detector
+	models   []Model
+	done     chan struct{}
+}
+
+// loadModels reads a JSON array of Model from path.
+func loadModels(path string) ([]Model, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeModels(data, path)
+}
+
+// decodeModels decodes a JSON array of Model, read from source. Files are
+// checked later, against --darknet-dir.
+func decodeModels(data []byte, source string) ([]Model, error) {
+	models := []Model{}
+	if err := json.Unmarshal(data, &models); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", source, err)
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("Invalid %s: at least one model is required", source)
+	}
+	names := map[string]bool{}
+	for i := range models {
+		m := &models[i]
+		if m.Weights == "" {
+			return nil, fmt.Errorf("Invalid model %d: Weights is required", i)
+		}
+		if m.Name == "" {
+			m.Name = modelName(m.Weights)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("Invalid model %s: duplicate Name", m.Name)
+		}
+		names[m.Name] = true
+	}
+	return models, nil
+}
+
+// flagModel returns the model set by --darknet-data, --model-config and
+// --model-weights.
+func flagModel(c DarknetDConfig) Model {
+	return Model{
+		Name:    modelName(c.modelWeightsFile),
+		Data:    c.darknetDataFile,
+		Config:  c.modelConfigFile,
+		Weights: c.modelWeightsFile,
+	}
+}
+
+func modelName(weights string) string {
+	base := filepath.Base(weights)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// modelNames joins the names of models, e.g. "coco+plates", to label
+// results of several models.
+func modelNames(models []Model) string {
+	names := []string{}
+	for _, m := range models {
+		names = append(names, m.Name)
+	}
+	return strings.Join(names, "+")
+}
+
+func sameModels(a, b []Model) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkModelFiles checks that the files of m exist within darknetDir.
+func checkModelFiles(m Model, darknetDir string) error {
+	for _, f := range []struct{ field, file string }{{"Data", m.Data}, {"Config", m.Config}, {"Weights", m.Weights}} {
+		if filepath.IsAbs(f.file) || strings.HasPrefix(filepath.Clean(f.file), "..") {
+			return fmt.Errorf("Invalid model %s: %s %s must be relative to --darknet-dir", m.Name, f.field, f.file)
+		}
+		path := filepath.Join(darknetDir, f.file)
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			return fmt.Errorf("Invalid model %s: %s %s is not a file", m.Name, f.field, path)
+		}
+	}
+	return nil
+}
+
+// validateModel fills in the defaults of m, a model to switch to, from the
+// running models, and checks its files. With several models running m must
+// name the one it replaces.
+func validateModel(m *Model, c DarknetDConfig) error {
+	var current Model
+	switch {
+	case len(c.models) == 1:
+		current = c.models[0]
+	case m.Name == "":
+		return fmt.Errorf("Invalid model: Name is required to replace one of %d models", len(c.models))
+	default:
+		for _, cm := range c.models {
+			if cm.Name == m.Name {
+				current = cm
+			}
+		}
+		if current.Name == "" {
+			return fmt.Errorf("Invalid model: no model named %s", m.Name)
+		}
+	}
+	if m.Weights == "" {
+		return fmt.Errorf("Invalid model: Weights is required")
+	}
+	if m.Data == "" {
+		m.Data = current.Data
+	}
+	if m.Config == "" {
+		m.Config = current.Config
+	}
+	if m.Name == "" {
+		m.Name = modelName(m.Weights)
+	}
+	return checkModelFiles(*m, c.darknetDir)
+}
+
+// switchModel starts darknet with m replacing the running model of the same
+// name (or the only one) alongside the current darknet and, once it is ready,
+// has the supervisor switch detections to it and stop the old process. On
+// error the current models keep running. Callers must hold switchmtx.
+func (dd *DarknetD) switchModel(m Model) error {
+	c := dd.currentConfig()
+	models := []Model{}
+	for _, cm := range c.models {
+		if len(c.models) == 1 || cm.Name == m.Name {
+			cm = m
+		}
+		models = append(models, cm)
+	}
+	c.models = models
+	log.Printf("Starting darknet with model %s", m.Name)
+	detector := dd.newDetector(c)
+	if err := detector.Start(); err != nil {
+		detector.Close()
+		return fmt.Errorf("Error starting darknet with model %s: %s", m.Name, err)
+	}
+	sw := modelSwitch{detector, models, make(chan struct{})}
+	select {
+	case dd.switches <- sw:
+	case <-time.After(c.darknetStartTimeout):
+		detector.Close()
+		return fmt.Errorf("Darknet is %s, try again later", dd.getState().Status)
+	}
+	<-sw.done
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSwitchModel(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	dir := newTestDir(t)
+	writeFile(t, filepath.Join(dir, "darknet", "night.weights"), "")
+	writeFile(t, filepath.Join(dir, "night.weights"), "")
+	td := startTestDaemon(t, dir)
+	td.capture("image1.jpg")
+	if lr := td.waitForImage("/objects", "image1.jpg"); lr.Model != "yolov3-tiny" {
+		t.Errorf("Unexpected model %s", lr.Model)
+	}
+
+	for _, body := range []string{`{"Weights": "../night.weights"}`, `{"Weights": "missing.weights"}`, `{"Weights":`} {
+		if status, _ := td.do("PUT", "/admin/model", "application/json", body); status != http.StatusBadRequest {
+			t.Errorf("PUT /admin/model %s: %d", body, status)
+		}
+	}
+	status, out := td.do("PUT", "/admin/model", "application/json", `{"Weights": "night.weights"}`)
+	model := Model{}
+	if err := json.Unmarshal([]byte(out), &model); status != http.StatusOK || err != nil {
+		t.Fatalf("PUT /admin/model: %d %s", status, out)
+	}
+	want := Model{Name: "night", Data: "cfg/coco.data", Config: "cfg/yolov3-tiny.cfg", Weights: "night.weights"}
+	if model != want {
+		t.Errorf("PUT /admin/model returned %+v", model)
+	}
+	state := DarknetState{}
+	td.getJSON("/status", &state)
+	if state.Model != "night" {
+		t.Errorf("/status returned model %s", state.Model)
+	}
+	if n := testutil.ToFloat64(td.metrics.ModelInfo.WithLabelValues("night")); n != 1 {
+		t.Errorf("darknetd_model_info for night is %v", n)
+	}
+	td.capture("image2.jpg")
+	if lr := td.waitForImage("/objects", "image2.jpg"); lr.Model != "night" {
+		t.Errorf("image2.jpg detected by %s", lr.Model)
+	}
+	if n := td.detections("default", "night"); n != 1 {
+		t.Errorf("Expected 1 detection by night, got %d", n)
+	}
+	if n := testutil.ToFloat64(td.metrics.DarknetRestarts); n != 0 {
+		t.Errorf("Model switch counted as %v darknet restarts", n)
+	}
+}
+
+func TestMultipleModels(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallel=%v", parallel), func(t *testing.T) {
+			t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+			dir := newTestDir(t)
+			writeFile(t, filepath.Join(dir, "darknet", "night.weights"), "")
+			writeFile(t, filepath.Join(dir, "models.json"), `[{"Name": "coco", "Weights": "yolov3-tiny.weights"}, {"Name": "plates", "Weights": "night.weights"}]`)
+			args := []string{"--models-file=DIR/models.json"}
+			if parallel {
+				args = append(args, "--models-parallel")
+			}
+			td := startTestDaemon(t, dir, args...)
+
+			td.capture("image1.jpg")
+			lr := td.waitForImage("/objects", "image1.jpg")
+			if lr.Model != "coco+plates" {
+				t.Errorf("Unexpected model %s", lr.Model)
+			}
+			if _, ok := lr.ModelTimes["coco"]; !ok || len(lr.ModelTimes) != 2 {
+				t.Errorf("Unexpected ModelTimes %v", lr.ModelTimes)
+			}
+			models := map[string]bool{}
+			for _, o := range lr.Objects {
+				if o.Class == "person" {
+					models[o.Model] = true
+				}
+			}
+			if !models["coco"] || !models["plates"] {
+				t.Errorf("Expected a person from each model, got %+v", lr.Objects)
+			}
+			if n := td.detections("default", "coco+plates"); n != 1 {
+				t.Errorf("Expected 1 detection, got %d", n)
+			}
+			if status, pred := td.get("/image/" + lr.PredImage); status != http.StatusOK || pred == "" {
+				t.Errorf("No prediction image: %d", status)
+			}
+		})
+	}
+}
+
+func TestSwitchOneOfMultipleModels(t *testing.T) {
+	dir := newTestDir(t)
+	writeFile(t, filepath.Join(dir, "darknet", "night.weights"), "")
+	writeFile(t, filepath.Join(dir, "models.json"), `[{"Name": "coco", "Weights": "yolov3-tiny.weights"}, {"Name": "plates", "Weights": "night.weights"}]`)
+	td := startTestDaemon(t, dir, "--models-file=DIR/models.json")
+
+	if status, _ := td.do("PUT", "/admin/model", "application/json", `{"Weights": "yolov3-tiny.weights"}`); status != http.StatusBadRequest {
+		t.Errorf("Switch without Name: %d", status)
+	}
+	if status, out := td.do("PUT", "/admin/model", "application/json", `{"Name": "plates", "Weights": "yolov3-tiny.weights"}`); status != http.StatusOK {
+		t.Fatalf("Switch plates: %d %s", status, out)
+	}
+	models := []Model{}
+	td.getJSON("/admin/models", &models)
+	want := Model{Name: "plates", Data: "cfg/coco.data", Config: "cfg/yolov3-tiny.cfg", Weights: "yolov3-tiny.weights"}
+	if len(models) != 2 || models[1] != want {
+		t.Errorf("/admin/models returned %+v", models)
+	}
+	model := Model{}
+	td.getJSON("/admin/model?name=coco", &model)
+	if model.Weights != "yolov3-tiny.weights" {
+		t.Errorf("/admin/model?name=coco returned %+v", model)
+	}
+	if status, _ := td.get("/admin/model?name=nope"); status != http.StatusNotFound {
+		t.Errorf("/admin/model?name=nope: %d", status)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// motionGate skips detection on frames that haven't changed since the last
+// one let through, so slow changes add up until they pass the threshold. Each frame is reduced to a motionGridWidth x motionGridHeight
+// grid of mean luma, and the motion score is the fraction of grid cells,
+// within the mask if any, whose luma changed by more than motionPixelDiff.
+// Frames scoring below the threshold are skipped, except that one is let
+// through every heartbeat, if set, so detections never stop entirely.
+type motionGate struct {
+	mtx        sync.Mutex
+	threshold  float64 // 0 disables the gate
+	heartbeat  time.Duration
+	mask       []bool // cells counted, nil for all
+	last       []uint8
+	lastDetect time.Time
+	recent     []bool                 // whether each recent frame was skipped, for skipRatio
+	frames     *prometheus.CounterVec // by result
+	skipRatio  prometheus.Gauge
+}
+
+func newMotionGate(frames *prometheus.CounterVec, skipRatio prometheus.Gauge) *motionGate {
+	return &motionGate{
+		frames:    frames,
+		skipRatio: skipRatio,
+	}
+}
+
+// configure applies the threshold, heartbeat and mask grid, e.g. after a
+// reload.
+func (g *motionGate) configure(threshold float64, heartbeat time.Duration, mask []bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.threshold = threshold
+	g.heartbeat = heartbeat
+	g.mask = mask
+}
+
+// check reports whether the image at path should be sent to darknet. Images
+// that can't be decoded are let through.
+func (g *motionGate) check(path string, now time.Time) bool {
+	g.mtx.Lock()
+	enabled := g.threshold > 0
+	g.mtx.Unlock()
+	if !enabled {
+		return true
+	}
+	grid, err := loadGrid(path)
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if err != nil {
+		log.Printf("Error checking %s for motion, detecting anyway: %s", path, err)
+		g.frames.WithLabelValues("error").Add(1)
+		return true
+	}
+	result := "motion"
+	if g.last != nil && motionScore(g.last, grid, g.mask) < g.threshold {
+		result = "skipped"
+		if g.heartbeat > 0 && now.Sub(g.lastDetect) >= g.heartbeat {
+			result = "heartbeat"
+		}
+	}
+	skipped := result == "skipped"
+	if !skipped {
+		g.last = grid
+		g.lastDetect = now
+	}
+	g.frames.WithLabelValues(result).Add(1)
+	g.recent = append(g.recent, skipped)
+	if len(g.recent) > motionRatioWindow {
+		g.recent = g.recent[1:]
+	}
+	n := 0
+	for _, s := range g.recent {
+		if s {
+			n++
+		}
+	}
+	g.skipRatio.Set(float64(n) / float64(len(g.recent)))
+	return !skipped
+}
+
+// motionScore returns the fraction of the cells counted by mask whose luma
+// changed by more than motionPixelDiff between a and b.
+func motionScore(a, b []uint8, mask []bool) float64 {
+	counted, changed := 0, 0
+	for i := range a {
+		if mask != nil && !mask[i] {
+			continue
+		}
+		counted++
+		d := int(a[i]) - int(b[i])
+		if d > motionPixelDiff || d < -motionPixelDiff {
+			changed++
+		}
+	}
+	if counted == 0 {
+		return 0
+	}
+	return float64(changed) / float64(counted)
+}
+
+// loadGrid decodes the image at path into a grid of mean luma.
+func loadGrid(path string) ([]uint8, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return lumaGrid(img), nil
+}
+
+// lumaGrid averages the luma of img over a motionGridWidth x
+// motionGridHeight grid of cells.
+func lumaGrid(img image.Image) []uint8 {
+	b := img.Bounds()
+	sums := make([]int, motionGridWidth*motionGridHeight)
+	counts := make([]int, len(sums))
+	ycbcr, isYCbCr := img.(*image.YCbCr)
+	gray, isGray := img.(*image.Gray)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := (y - b.Min.Y) * motionGridHeight / b.Dy() * motionGridWidth
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var luma uint8
+			switch {
+			case isYCbCr:
+				luma = ycbcr.Y[ycbcr.YOffset(x, y)]
+			case isGray:
+				luma = gray.Pix[gray.PixOffset(x, y)]
+			default:
+				luma = color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+			}
+			cell := row + (x-b.Min.X)*motionGridWidth/b.Dx()
+			sums[cell] += int(luma)
+			counts[cell]++
+		}
+	}
+	grid := make([]uint8, len(sums))
+	for i := range sums {
+		if counts[i] > 0 {
+			grid[i] = uint8(sums[i] / counts[i])
+		}
+	}
+	return grid
+}
+
+// loadMotionMask reads a mask image, JPEG or PNG, in which motion in white
+// areas counts and motion in black areas is ignored. It is scaled to the
+// motion grid, so should have the camera's aspect ratio.
+func loadMotionMask(path string) ([]bool, error) {
+	grid, err := loadGrid(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading motion mask %s: %s", path, err)
+	}
+	mask := make([]bool, len(grid))
+	counted := false
+	for i, luma := range grid {
+		mask[i] = luma >= 128
+		counted = counted || mask[i]
+	}
+	if !counted {
+		return nil, fmt.Errorf("Motion mask %s is all black", path)
+	}
+	return mask, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeBand writes a black 320x240 image to path, JPEG or PNG by extension,
+// with a white band across columns x to x+width.
+func writeBand(t *testing.T, path string, x, width int) {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 320, 240))
+	for py := 0; py < 240; py++ {
+		for px := x; px < x+width && px < 320; px++ {
+			img.SetGray(px, py, color.Gray{Y: 255})
+		}
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasSuffix(path, ".png") {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, img, nil)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMotionGating(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	dir := newTestDir(t)
+	// only the left half of the frame counts
+	writeBand(t, filepath.Join(dir, "mask.png"), 0, 160)
+	writeFile(t, filepath.Join(dir, "motion.yaml"), "motion-threshold: 0.05\nmotion-heartbeat: 1s\nmotion-mask: "+filepath.Join(dir, "mask.png")+"\nbacklog: all\n")
+	td := startTestDaemon(t, dir, "--config=DIR/motion.yaml")
+	motion := func(result string) int {
+		return int(testutil.ToFloat64(td.metrics.MotionFrames.WithLabelValues("default", result)))
+	}
+	frame := func(name string, x int) {
+		writeBand(t, filepath.Join(dir, "archive", name), x, 40)
+	}
+
+	frame("motion1.jpg", 200)
+	waitFor(t, "the first frame", func() bool { return motion("motion") == 1 })
+	frame("motion2.jpg", 250)
+	waitFor(t, "a frame without motion in the mask", func() bool { return motion("skipped") == 1 })
+	frame("motion3.jpg", 250)
+	waitFor(t, "a frame without motion", func() bool { return motion("skipped") == 2 })
+	frame("motion4.jpg", 10)
+	waitFor(t, "a frame with motion in the mask", func() bool { return motion("motion") == 2 })
+	td.waitForImage("/objects", "motion4.jpg")
+	for _, image := range []string{"motion2.jpg", "motion3.jpg"} {
+		if _, ok := findImage(td.objects(""), image); ok {
+			t.Errorf("%s detected without motion", image)
+		}
+	}
+	if r := testutil.ToFloat64(td.metrics.MotionSkipRatio.WithLabelValues("default")); r != 0.5 {
+		t.Errorf("Expected a skip ratio of 0.5, got %v", r)
+	}
+
+	time.Sleep(time.Second)
+	frame("motion5.jpg", 10)
+	waitFor(t, "a heartbeat frame", func() bool { return motion("heartbeat") == 1 })
+	td.waitForImage("/objects", "motion5.jpg")
+}
+
+func TestMotionSlowDrift(t *testing.T) {
+	dir := t.TempDir()
+	g := newMotionGate(
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "frames"}, []string{"result"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "skip_ratio"}),
+	)
+	g.configure(0.2, 0, nil)
+	// each frame moves the band an eighth of the width from the one before,
+	// under the threshold, but a quarter from the last one let through
+	for _, tc := range []struct {
+		x    int
+		want bool
+	}{{0, true}, {20, false}, {40, true}, {60, false}} {
+		path := filepath.Join(dir, "frame.png")
+		writeBand(t, path, tc.x, 40)
+		if got := g.check(path, time.Now()); got != tc.want {
+			t.Errorf("Band at %d let through: %v, expected %v", tc.x, got, tc.want)
+		}
+	}
+}
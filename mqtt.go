@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MQTTPublisher publishes every detection and per-class presence/count topics
+// under a topic prefix:
+//
+//	<prefix>/status                online/offline, follows the darknet process (LWT offline)
+//	<prefix>/detection             DarknetResult JSON
+//	<prefix>/<class>/count         number of objects of class in the latest detection
+//	<prefix>/<class>/presence      ON/OFF
+//
+// With more than one camera, the class topics move under the camera name:
+// <prefix>/<camera>/<class>/count. With a discovery prefix set, Home Assistant
+// discovery configs are published for each class the first time it is seen.
+type MQTTPublisher struct {
+	client          mqtt.Client
+	prefix          string
+	discoveryPrefix string
+	nodeID          string
+	qos             byte
+	retain          bool
+	perCamera       bool
+
+	online     bool
+	counts     map[string]map[string]int // camera -> class -> objects
+	discovered map[string]bool
+	mtx        sync.Mutex
+
+	published *prometheus.CounterVec
+	connected prometheus.Gauge
+}
+
+type mqttConfig struct {
+	broker          string
+	username        string
+	password        string
+	prefix          string
+	discoveryPrefix string
+	qos             byte
+	retain          bool
+}
+
+var topicUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+func topicName(s string) string {
+	return strings.Trim(topicUnsafe.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
+
+func newMQTTPublisher(c mqttConfig, published *prometheus.CounterVec, connected prometheus.Gauge) *MQTTPublisher {
+	p := &MQTTPublisher{
+		prefix:          c.prefix,
+		discoveryPrefix: c.discoveryPrefix,
+		nodeID:          topicName(c.prefix),
+		qos:             c.qos,
+		retain:          c.retain,
+		counts:          map[string]map[string]int{},
+		discovered:      map[string]bool{},
+		published:       published,
+		connected:       connected,
+	}
+	hostname, _ := os.Hostname()
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.broker).
+		SetClientID(fmt.Sprintf("darknetd-%s-%s", hostname, p.nodeID)).
+		SetUsername(c.username).
+		SetPassword(c.password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(p.prefix+"/status", "offline", c.qos, true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Printf("MQTT connected to %s", c.broker)
+			p.connected.Set(1)
+			p.mtx.Lock()
+			p.discovered = map[string]bool{} // republish discovery after broker restarts
+			online := p.online
+			p.mtx.Unlock()
+			p.publishStatus(online)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection to %s lost: %s", c.broker, err)
+			p.connected.Set(0)
+		})
+	p.client = mqtt.NewClient(opts)
+	return p
+}
+
+// start connects to the broker in the background and publishes detections
+// from events and the darknet process status.
+func (p *MQTTPublisher) start(dd *DarknetD) error {
+	p.perCamera = len(dd.cameras) > 1
+	p.client.Connect() // retries in the background with SetConnectRetry
+	dd.onStatus(func(status DarknetJobStatus) {
+		p.mtx.Lock()
+		p.online = status == DARKNET_RUNNING
+		p.mtx.Unlock()
+		p.publishStatus(status == DARKNET_RUNNING)
+	})
+	sub := dd.events.Subscribe("mqtt", resultFilter{})
+	go func() {
+		for lr := range sub.ch {
+			p.publishResult(lr)
+		}
+	}()
+	return nil
+}
+
+func (p *MQTTPublisher) stop() {
+	p.publishStatus(false)
+	p.client.Disconnect(uint(mqttTimeout / time.Millisecond))
+}
+
+func (p *MQTTPublisher) publishStatus(online bool) {
+	if online {
+		p.publish("status", "online", true)
+	} else {
+		p.publish("status", "offline", true)
+	}
+}
+
+func (p *MQTTPublisher) publishResult(lr DarknetResult) {
+	out, err := json.Marshal(lr)
+	if err != nil {
+		log.Printf("MQTT: %s", err)
+		return
+	}
+	p.publish("detection", out, p.retain)
+
+	counts := map[string]int{}
+	for _, o := range lr.Objects {
+		counts[o.Class]++
+	}
+	camera := ""
+	if p.perCamera {
+		camera = lr.Camera
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	last, ok := p.counts[camera]
+	if !ok {
+		last = map[string]int{}
+		p.counts[camera] = last
+	}
+	for class := range last {
+		if _, ok := counts[class]; !ok {
+			counts[class] = 0
+		}
+	}
+	for class, n := range counts {
+		subtopic := p.classTopic(camera, class)
+		if p.discoveryPrefix != "" && !p.discovered[subtopic] {
+			p.publishDiscovery(camera, class)
+			p.discovered[subtopic] = true
+		}
+		if l, ok := last[class]; ok && l == n {
+			continue
+		}
+		presence := "OFF"
+		if n > 0 {
+			presence = "ON"
+		}
+		p.publish(subtopic+"/count", fmt.Sprint(n), p.retain)
+		p.publish(subtopic+"/presence", presence, p.retain)
+		last[class] = n
+	}
+}
+
+// classTopic returns the subtopic for class, under camera if set.
+func (p *MQTTPublisher) classTopic(camera, class string) string {
+	if camera == "" {
+		return topicName(class)
+	}
+	return topicName(camera) + "/" + topicName(class)
+}
+
+// publishDiscovery announces a presence binary_sensor and a count sensor for
+// class to Home Assistant. Callers must hold mtx.
+func (p *MQTTPublisher) publishDiscovery(camera, class string) {
+	device := map[string]interface{}{
+		"identifiers":  []string{"darknetd_" + p.nodeID},
+		"name":         "darknetd " + p.prefix,
+		"model":        "darknetd",
+		"manufacturer": "darknetd",
+		"sw_version":   version,
+	}
+	subtopic := p.classTopic(camera, class)
+	id := fmt.Sprintf("darknetd_%s_%s", p.nodeID, strings.Replace(subtopic, "/", "_", -1))
+	name := class
+	if camera != "" {
+		name = camera + " " + class
+	}
+	configs := map[string]map[string]interface{}{
+		fmt.Sprintf("binary_sensor/%s/config", id): {
+			"name":               name,
+			"unique_id":          id,
+			"state_topic":        fmt.Sprintf("%s/%s/presence", p.prefix, subtopic),
+			"availability_topic": p.prefix + "/status",
+			"device_class":       "occupancy",
+			"device":             device,
+		},
+		fmt.Sprintf("sensor/%s_count/config", id): {
+			"name":                name + " count",
+			"unique_id":           id + "_count",
+			"state_topic":         fmt.Sprintf("%s/%s/count", p.prefix, subtopic),
+			"availability_topic":  p.prefix + "/status",
+			"unit_of_measurement": "objects",
+			"state_class":         "measurement",
+			"device":              device,
+		},
+	}
+	for topic, config := range configs {
+		out, err := json.Marshal(config)
+		if err != nil {
+			log.Printf("MQTT: %s", err)
+			continue
+		}
+		p.publishTopic(p.discoveryPrefix+"/"+topic, out, true)
+	}
+}
+
+func (p *MQTTPublisher) publish(subtopic string, payload interface{}, retain bool) {
+	p.publishTopic(p.prefix+"/"+subtopic, payload, retain)
+}
+
+func (p *MQTTPublisher) publishTopic(topic string, payload interface{}, retain bool) {
+	if !p.client.IsConnectionOpen() {
+		p.published.WithLabelValues("disconnected").Add(1)
+		return
+	}
+	t := p.client.Publish(topic, p.qos, retain, payload)
+	go func() {
+		if !t.WaitTimeout(mqttTimeout) {
+			p.published.WithLabelValues("timeout").Add(1)
+			return
+		}
+		if t.Error() != nil {
+			log.Printf("MQTT publish to %s failed: %s", topic, t.Error())
+			p.published.WithLabelValues("error").Add(1)
+			return
+		}
+		p.published.WithLabelValues("ok").Add(1)
+	}()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startBroker runs an embedded MQTT broker on a free port and returns its
+// tcp:// URL. It is closed when the test ends.
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+	server := mochi.New(nil)
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, "tcp://" + tcp.Address()
+}
+
+// mqttMessages records every message published under a topic filter.
+type mqttMessages struct {
+	msgs map[string][]string
+	mtx  sync.Mutex
+}
+
+func subscribe(t *testing.T, broker, clientID, filter string) *mqttMessages {
+	t.Helper()
+	m := &mqttMessages{msgs: map[string][]string{}}
+	client := paho.NewClient(paho.NewClientOptions().AddBroker(broker).SetClientID(clientID))
+	if tok := client.Connect(); !tok.WaitTimeout(mqttTimeout) || tok.Error() != nil {
+		t.Fatalf("Error connecting to %s: %v", broker, tok.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(100) })
+	tok := client.Subscribe(filter, 1, func(_ paho.Client, msg paho.Message) {
+		m.mtx.Lock()
+		defer m.mtx.Unlock()
+		m.msgs[msg.Topic()] = append(m.msgs[msg.Topic()], string(msg.Payload()))
+	})
+	if !tok.WaitTimeout(mqttTimeout) || tok.Error() != nil {
+		t.Fatalf("Error subscribing to %s: %v", filter, tok.Error())
+	}
+	return m
+}
+
+// all returns the payloads published to topic, oldest first.
+func (m *mqttMessages) all(topic string) []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]string(nil), m.msgs[topic]...)
+}
+
+// last returns the latest payload published to topic.
+func (m *mqttMessages) last(topic string) string {
+	msgs := m.all(topic)
+	if len(msgs) == 0 {
+		return ""
+	}
+	return msgs[len(msgs)-1]
+}
+
+func (m *mqttMessages) waitFor(t *testing.T, topic, payload string) {
+	t.Helper()
+	waitFor(t, topic+" "+payload, func() bool { return m.last(topic) == payload })
+}
+
+func TestMQTT(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	broker, url := startBroker(t)
+	msgs := subscribe(t, url, "test", "#")
+	td := startTestDaemon(t, newTestDir(t), "--mqtt-broker="+url)
+	msgs.waitFor(t, "darknetd/status", "online")
+
+	// the client registers an offline LWT with the broker
+	clients := broker.Clients.GetAll()
+	if len(clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(clients))
+	}
+	for _, cl := range clients {
+		if cl.ID == "test" {
+			continue
+		}
+		will := cl.Properties.Will
+		if will.TopicName != "darknetd/status" || string(will.Payload) != "offline" || !will.Retain {
+			t.Errorf("Unexpected LWT %+v", will)
+		}
+	}
+
+	td.capture("image1.jpg")
+	msgs.waitFor(t, "darknetd/person/presence", "ON")
+	if n := msgs.last("darknetd/person/count"); n != "1" {
+		t.Errorf("darknetd/person/count is %q", n)
+	}
+	lr := DarknetResult{}
+	if err := json.Unmarshal([]byte(msgs.last("darknetd/detection")), &lr); err != nil || lr.Image != "image1.jpg" {
+		t.Errorf("Unexpected detection %+v: %v", lr, err)
+	}
+
+	td.capture("image2.jpg")
+	msgs.waitFor(t, "darknetd/dog/presence", "ON")
+	td.capture("image3.jpg")
+	msgs.waitFor(t, "darknetd/person/presence", "OFF")
+	msgs.waitFor(t, "darknetd/dog/presence", "OFF")
+	if n := msgs.last("darknetd/person/count"); n != "0" {
+		t.Errorf("darknetd/person/count is %q after an empty detection", n)
+	}
+	if counts := msgs.all("darknetd/person/count"); len(counts) != 2 {
+		t.Errorf("Unchanged counts republished: %q", counts)
+	}
+
+	var sensor, count map[string]interface{}
+	if err := json.Unmarshal([]byte(msgs.last("homeassistant/binary_sensor/darknetd_darknetd_person/config")), &sensor); err != nil {
+		t.Fatalf("Bad binary_sensor discovery: %v", err)
+	}
+	if sensor["state_topic"] != "darknetd/person/presence" || sensor["availability_topic"] != "darknetd/status" ||
+		sensor["device_class"] != "occupancy" || sensor["unique_id"] != "darknetd_darknetd_person" {
+		t.Errorf("Unexpected binary_sensor discovery %v", sensor)
+	}
+	if err := json.Unmarshal([]byte(msgs.last("homeassistant/sensor/darknetd_darknetd_person_count/config")), &count); err != nil {
+		t.Fatalf("Bad sensor discovery: %v", err)
+	}
+	if count["state_topic"] != "darknetd/person/count" || count["unit_of_measurement"] != "objects" ||
+		count["state_class"] != "measurement" {
+		t.Errorf("Unexpected sensor discovery %v", count)
+	}
+
+	td.stop()
+	msgs.waitFor(t, "darknetd/status", "offline")
+
+	// a late subscriber gets the retained status and discovery, but not the
+	// detection without --mqtt-retain
+	late := subscribe(t, url, "late", "#")
+	late.waitFor(t, "darknetd/status", "offline")
+	late.waitFor(t, "homeassistant/binary_sensor/darknetd_darknetd_dog/config", msgs.last("homeassistant/binary_sensor/darknetd_darknetd_dog/config"))
+	if d := late.last("darknetd/detection"); d != "" {
+		t.Errorf("Detection retained without --mqtt-retain: %s", d)
+	}
+}
+
+func TestMQTTStatusFollowsDarknet(t *testing.T) {
+	t.Setenv("FAKEDARKNET_MODE", "crash")
+	t.Setenv("FAKEDARKNET_CRASH_AFTER", "1")
+	_, url := startBroker(t)
+	msgs := subscribe(t, url, "test", "darknetd/status")
+	td := startTestDaemon(t, newTestDir(t), "--mqtt-broker="+url)
+	msgs.waitFor(t, "darknetd/status", "online")
+
+	td.timelapse()
+	waitFor(t, "offline then online", func() bool {
+		status := msgs.all("darknetd/status")
+		for i := 1; i < len(status); i++ {
+			if status[i-1] == "offline" && status[i] == "online" {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// multiDetector runs each image through several models, each its own
+// Detector, and merges their objects into one result. Models run in
+// sequence, or in parallel. The prediction image is the first model's.
+type multiDetector struct {
+	models    []Model
+	detectors []Detector
+	parallel  bool
+
+	done    chan struct{}
+	err     error
+	errOnce sync.Once
+}
+
+func newMultiDetector(models []Model, detectors []Detector, parallel bool) *multiDetector {
+	return &multiDetector{
+		models:    models,
+		detectors: detectors,
+		parallel:  parallel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start starts all models in parallel, failing if any of them fails.
+func (md *multiDetector) Start() error {
+	errs := make([]error, len(md.detectors))
+	var wg sync.WaitGroup
+	for i, d := range md.detectors {
+		wg.Add(1)
+		go func(i int, d Detector) {
+			defer wg.Done()
+			errs[i] = d.Start()
+		}(i, d)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			md.Close()
+			return fmt.Errorf("Model %s: %s", md.models[i].Name, err)
+		}
+	}
+	for i, d := range md.detectors {
+		go func(name string, d Detector) {
+			<-d.Done()
+			md.exit(fmt.Errorf("Model %s: %s", name, d.Err()))
+		}(md.models[i].Name, d)
+	}
+	return nil
+}
+
+func (md *multiDetector) exit(err error) {
+	md.errOnce.Do(func() {
+		md.err = err
+		close(md.done)
+	})
+}
+
+// Detect merges the objects of all models, setting their Model. ModelTimes
+// holds the prediction time of each model, and TimeDetect their total, or
+// the longest when run in parallel.
+func (md *multiDetector) Detect(imgPath, predPath string) (DarknetResult, error) {
+	results := make([]DarknetResult, len(md.detectors))
+	errs := make([]error, len(md.detectors))
+	detect := func(i int) {
+		pred := predPath
+		if i > 0 {
+			pred = ""
+		}
+		results[i], errs[i] = md.detectors[i].Detect(imgPath, pred)
+	}
+	if md.parallel {
+		var wg sync.WaitGroup
+		for i := range md.detectors {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				detect(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range md.detectors {
+			if detect(i); errs[i] != nil {
+				break
+			}
+		}
+	}
+
+	merged := DarknetResult{
+		Objects:    []Object{},
+		ModelTimes: map[string]float64{},
+	}
+	for i, r := range results {
+		name := md.models[i].Name
+		if err := errs[i]; err != nil {
+			if derr, ok := err.(detectorError); ok {
+				return DarknetResult{}, detectorError{fmt.Errorf("Model %s: %s", name, derr.err), derr.fatal}
+			}
+			return DarknetResult{}, fmt.Errorf("Model %s: %s", name, err)
+		}
+		for _, o := range r.Objects {
+			o.Model = name
+			merged.Objects = append(merged.Objects, o)
+		}
+		merged.ModelTimes[name] = r.TimeDetect
+		if !md.parallel {
+			merged.TimeDetect += r.TimeDetect
+		} else if r.TimeDetect > merged.TimeDetect {
+			merged.TimeDetect = r.TimeDetect
+		}
+	}
+	return merged, nil
+}
+
+func (md *multiDetector) Done() <-chan struct{} {
+	return md.done
+}
+
+func (md *multiDetector) Err() error {
+	select {
+	case <-md.done:
+		return md.err
+	default:
+		return nil
+	}
+}
+
+// Close stops all models.
+func (md *multiDetector) Close() error {
+	var err error
+	for i, d := range md.detectors {
+		if cerr := d.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Model %s: %s", md.models[i].Name, cerr)
+		}
+	}
+	return err
+}
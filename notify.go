@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WebhookRule POSTs a WebhookPayload to URL when a detection from Camera (any
+// if empty) has objects matching Classes, Zone and MinProb, optionally only
+// between From and To ("HH:MM", local time, may wrap midnight). A rule fires
+// once the match has held for MinFrames consecutive detections, then stays
+// quiet for Cooldown.
+type WebhookRule struct {
+	Name        string
+	URL         string
+	Camera      string
+	Classes     []string
+	Zone        string
+	MinProb     int
+	From        string
+	To          string
+	MinFrames   int
+	Cooldown    string
+	AttachImage bool
+
+	filter   resultFilter
+	from     time.Duration
+	to       time.Duration
+	cooldown time.Duration
+	frames   int
+	lastSent time.Time
+	queue    chan WebhookPayload
+}
+
+type WebhookPayload struct {
+	Rule          string
+	Result        DarknetResult
+	PredImageData []byte `json:",omitempty"`
+}
+
+type notifierMetrics struct {
+	deliveries *prometheus.CounterVec
+	retries    *prometheus.CounterVec
+	dropped    *prometheus.CounterVec
+}
+
+// Notifier evaluates webhook rules against every detection and delivers
+// matches in the background, one queue and worker per rule, so a slow or
+// failing endpoint only delays its own rule.
+type Notifier struct {
+	rules      []*WebhookRule
+	rulesmtx   sync.Mutex
+	archiveDir func(camera string) string
+	client     *http.Client
+	metrics    notifierMetrics
+}
+
+// loadWebhookRules reads a JSON array of WebhookRule from path.
+func loadWebhookRules(path string) ([]*WebhookRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeWebhookRules(data, path)
+}
+
+// decodeWebhookRules decodes a JSON array of WebhookRule, read from source.
+func decodeWebhookRules(data []byte, source string) ([]*WebhookRule, error) {
+	rules := []*WebhookRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", source, err)
+	}
+	for i, r := range rules {
+		if err := r.init(); err != nil {
+			return nil, fmt.Errorf("Invalid webhook rule %d (%s): %s", i, r.Name, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *WebhookRule) init() error {
+	if r.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if r.URL == "" {
+		return fmt.Errorf("URL is required")
+	}
+	if r.MinProb < 0 || r.MinProb > 100 {
+		return fmt.Errorf("MinProb must be between 0 and 100")
+	}
+	r.filter = resultFilter{camera: r.Camera, zone: r.Zone, minProb: r.MinProb, nonEmpty: true}
+	if len(r.Classes) > 0 {
+		r.filter.classes = map[string]bool{}
+		for _, c := range r.Classes {
+			r.filter.classes[c] = true
+		}
+	}
+	if (r.From == "") != (r.To == "") {
+		return fmt.Errorf("From and To must be set together")
+	}
+	if r.From != "" {
+		var err error
+		if r.from, err = parseTimeOfDay(r.From); err != nil {
+			return err
+		}
+		if r.to, err = parseTimeOfDay(r.To); err != nil {
+			return err
+		}
+	}
+	if r.Cooldown != "" {
+		var err error
+		if r.cooldown, err = time.ParseDuration(r.Cooldown); err != nil {
+			return fmt.Errorf("Invalid Cooldown: %s", err)
+		}
+	}
+	if r.MinFrames < 1 {
+		r.MinFrames = 1
+	}
+	r.queue = make(chan WebhookPayload, webhookQueueSize)
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active reports whether t falls in the rule's From-To window.
+func (r *WebhookRule) active(t time.Time) bool {
+	if r.From == "" {
+		return true
+	}
+	h, m, _ := t.Clock()
+	tod := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+	if r.from <= r.to {
+		return tod >= r.from && tod < r.to
+	}
+	return tod >= r.from || tod < r.to
+}
+
+func newNotifier(archiveDir func(camera string) string, metrics notifierMetrics) *Notifier {
+	return &Notifier{
+		archiveDir: archiveDir,
+		client:     &http.Client{Timeout: webhookTimeout},
+		metrics:    metrics,
+	}
+}
+
+// start runs a delivery worker per rule.
+func (n *Notifier) start(rules []*WebhookRule) error {
+	n.setRules(rules)
+	return nil
+}
+
+// setRules replaces the rules, e.g. on reload. Rules that are kept, by Name,
+// keep their cooldown and consecutive frames. Notifications already queued
+// for the old rules are still delivered.
+func (n *Notifier) setRules(rules []*WebhookRule) {
+	for _, r := range rules {
+		go n.deliver(r)
+	}
+	n.rulesmtx.Lock()
+	old := n.rules
+	kept := map[string]*WebhookRule{}
+	for _, r := range old {
+		kept[r.Name] = r
+	}
+	for _, r := range rules {
+		if o, ok := kept[r.Name]; ok {
+			r.lastSent = o.lastSent
+			r.frames = o.frames
+		}
+	}
+	n.rules = rules
+	n.rulesmtx.Unlock()
+	for _, r := range old {
+		close(r.queue)
+	}
+}
+
+// evaluate queues notifications for the rules lr matches. It is called for
+// every detection, unlike stream subscribers, which drop detections when they
+// fall behind.
+func (n *Notifier) evaluate(lr DarknetResult) {
+	n.rulesmtx.Lock()
+	defer n.rulesmtx.Unlock()
+	for _, r := range n.rules {
+		flr, ok := r.filter.apply(lr)
+		if !ok || !r.active(lr.PredTime) {
+			r.frames = 0
+			continue
+		}
+		r.frames++
+		if r.frames < r.MinFrames || lr.PredTime.Sub(r.lastSent) < r.cooldown {
+			continue
+		}
+		p := WebhookPayload{Rule: r.Name, Result: flr}
+		if r.AttachImage && lr.PredImage != "" {
+			var err error
+			p.PredImageData, err = ioutil.ReadFile(filepath.Join(n.archiveDir(lr.Camera), lr.PredImage))
+			if err != nil {
+				log.Printf("Webhook %s: error reading prediction image: %s", r.Name, err)
+			}
+		}
+		select {
+		case r.queue <- p:
+			r.lastSent = lr.PredTime
+		default:
+			n.metrics.dropped.WithLabelValues(r.Name).Add(1)
+		}
+	}
+}
+
+func (n *Notifier) deliver(r *WebhookRule) {
+	for p := range r.queue {
+		body, err := json.Marshal(p)
+		if err != nil {
+			log.Printf("Webhook %s: %s", r.Name, err)
+			n.metrics.deliveries.WithLabelValues(r.Name, "failed").Add(1)
+			continue
+		}
+		delay := webhookRetryDelay
+		for attempt := 1; ; attempt++ {
+			err = n.post(r.URL, body)
+			if err == nil {
+				n.metrics.deliveries.WithLabelValues(r.Name, "ok").Add(1)
+				break
+			}
+			if attempt >= webhookMaxAttempts {
+				log.Printf("Webhook %s: giving up after %d attempts: %s", r.Name, attempt, err)
+				n.metrics.deliveries.WithLabelValues(r.Name, "failed").Add(1)
+				break
+			}
+			log.Printf("Webhook %s: retrying in %v: %s", r.Name, delay, err)
+			n.metrics.retries.WithLabelValues(r.Name).Add(1)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (n *Notifier) post(url string, body []byte) error {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
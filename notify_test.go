@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWebhookRetries(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	var mtx sync.Mutex
+	requests := 0
+	payloads := []WebhookPayload{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		if requests == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		p := WebhookPayload{}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("Bad webhook payload: %s", err)
+		}
+		payloads = append(payloads, p)
+	}))
+	defer hook.Close()
+	dir := newTestDir(t)
+	writeFile(t, filepath.Join(dir, "webhooks.json"), `[{"Name": "people", "URL": "`+hook.URL+`", "Classes": ["person"], "AttachImage": true}]`)
+	td := startTestDaemon(t, dir, "--webhooks-file=DIR/webhooks.json")
+
+	td.capture("image1.jpg")
+	deliveries := td.metrics.WebhookDeliveries.WithLabelValues("people", "ok")
+	waitFor(t, "the webhook to be delivered", func() bool { return testutil.ToFloat64(deliveries) == 1 })
+	if n := testutil.ToFloat64(td.metrics.WebhookRetries.WithLabelValues("people")); n != 1 {
+		t.Errorf("Expected 1 retry, got %v", n)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(payloads) != 1 {
+		t.Fatalf("Expected 1 payload, got %d", len(payloads))
+	}
+	p := payloads[0]
+	if p.Rule != "people" || p.Result.Image != "image1.jpg" || len(p.Result.Objects) != 1 || string(p.PredImageData) != fakeJPEG("image1.jpg") {
+		t.Errorf("Unexpected payload %+v", p)
+	}
+}
+
+func TestWebhookSeesEveryDetection(t *testing.T) {
+	var mtx sync.Mutex
+	payloads := []WebhookPayload{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		p := WebhookPayload{}
+		json.NewDecoder(r.Body).Decode(&p)
+		payloads = append(payloads, p)
+	}))
+	defer hook.Close()
+	dir := newTestDir(t)
+	// fires only if none of the flood of detections is missed
+	frames := 4 * streamBufferSize
+	writeFile(t, filepath.Join(dir, "webhooks.json"), fmt.Sprintf(`[{"Name": "people", "URL": "%s", "Classes": ["person"], "MinFrames": %d}]`, hook.URL, frames))
+	td := startTestDaemon(t, dir, "--webhooks-file=DIR/webhooks.json")
+
+	for n := 1; n <= frames; n++ {
+		lr := DarknetResult{Image: fmt.Sprintf("flood%d.jpg", n), Objects: []Object{{Class: "person", Prob: 90}}}
+		td.addDetection(td.cameras[0], &lr)
+	}
+	deliveries := td.metrics.WebhookDeliveries.WithLabelValues("people", "ok")
+	waitFor(t, "the webhook to be delivered", func() bool { return testutil.ToFloat64(deliveries) == 1 })
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(payloads) != 1 || payloads[0].Result.Image != fmt.Sprintf("flood%d.jpg", frames) {
+		t.Errorf("Unexpected payloads %+v", payloads)
+	}
+}
+
+func TestWebhookCooldownSurvivesReload(t *testing.T) {
+	var mtx sync.Mutex
+	requests := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+	}))
+	defer hook.Close()
+	rules := func() []*WebhookRule {
+		rules, err := decodeWebhookRules([]byte(`[{"Name": "people", "URL": "`+hook.URL+`", "Classes": ["person"], "Cooldown": "1h"}]`), "rules")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rules
+	}
+	deliveries := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "deliveries"}, []string{"rule", "status"})
+	n := newNotifier(func(string) string { return "" }, notifierMetrics{
+		deliveries: deliveries,
+		retries:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "retries"}, []string{"rule"}),
+		dropped:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dropped"}, []string{"rule"}),
+	})
+	n.start(rules())
+	lr := DarknetResult{PredTime: time.Now(), Objects: []Object{{Class: "person", Prob: 90}}}
+	n.evaluate(lr)
+	waitFor(t, "the webhook to be delivered", func() bool { return testutil.ToFloat64(deliveries.WithLabelValues("people", "ok")) == 1 })
+
+	n.setRules(rules())
+	lr.PredTime = lr.PredTime.Add(time.Minute)
+	n.evaluate(lr)
+	time.Sleep(200 * time.Millisecond)
+	mtx.Lock()
+	defer mtx.Unlock()
+	if requests != 1 {
+		t.Errorf("Cooldown reset by reload, %d webhooks sent", requests)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// outputParser turns darknet's stdout for a single image into a DarknetResult.
+// Lines it doesn't recognize are returned so the caller can count them.
+type outputParser func(imgPath string, lines []string) (DarknetResult, []string)
+
+type darknetFlavor struct {
+	parse outputParser
+	args  []string // appended to `darknet detector test`
+}
+
+// darknetFlavors maps --darknet-flavor names to output parsers. The patches in
+// etc/darknet-patches make every fork print the same CLASS/BBOX lines; the
+// forks differ in timing units and the noise around them. AlexeyAB is also
+// run with -ext_output, so unpatched builds report bounding boxes too; auto
+// restarts darknet with these args once it has detected the fork.
+var darknetFlavors = map[string]darknetFlavor{
+	"pjreddie": {parse: parsePjreddieOutput},
+	"nnpack":   {parse: parsePjreddieOutput},
+	"alexeyab": {parse: parseAlexeyABOutput, args: []string{"-ext_output", "-dont_show"}},
+}
+
+var (
+	predictedRegexp = regexp.MustCompile(`^(.*): Predicted in ([0-9.]+) (seconds|milli-seconds)\.$`)
+	extOutputRegexp = regexp.MustCompile(`^(.+): (\d+)%\s+\(left_x:\s*(-?\d+)\s+top_y:\s*(-?\d+)\s+width:\s*(-?\d+)\s+height:\s*(-?\d+)\)$`)
+
+	// alexeyABNoise is printed by AlexeyAB builds with OpenCV when there is no display.
+	alexeyABNoise = []*regexp.Regexp{
+		regexp.MustCompile(`^Unable to init server`),
+		regexp.MustCompile(`Gtk-WARNING`),
+	}
+	// alexeyABBanner matches startup lines only AlexeyAB prints.
+	alexeyABBanner = []*regexp.Regexp{
+		regexp.MustCompile(`Total BFLOPS`),
+		regexp.MustCompile(`net\.optimized_memory`),
+		regexp.MustCompile(`mini_batch = \d+, batch = \d+`),
+		regexp.MustCompile(`Try to load cfg:`),
+	}
+)
+
+// detectFlavor guesses the darknet fork from its startup output. pjreddie and
+// darknet-nnpack print identical banners, so anything that isn't AlexeyAB gets
+// the pjreddie parser, which handles both.
+func detectFlavor(banner []string) string {
+	for _, line := range banner {
+		for _, re := range alexeyABBanner {
+			if re.MatchString(line) {
+				return "alexeyab"
+			}
+		}
+	}
+	return "pjreddie"
+}
+
+func parsePjreddieOutput(imgPath string, lines []string) (DarknetResult, []string) {
+	return parseLines(imgPath, lines, false, nil)
+}
+
+func parseAlexeyABOutput(imgPath string, lines []string) (DarknetResult, []string) {
+	return parseLines(imgPath, lines, true, alexeyABNoise)
+}
+
+func parseLines(imgPath string, lines []string, extOutput bool, noise []*regexp.Regexp) (DarknetResult, []string) {
+	lr := DarknetResult{}
+	unknown := []string{}
+	var bounds image.Rectangle
+lines:
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if m := extOutputRegexp.FindStringSubmatch(line); extOutput && m != nil {
+			if bounds.Empty() {
+				bounds = imageBounds(imgPath)
+			}
+			o, err := parseExtOutput(m, bounds)
+			if err != nil {
+				log.Printf("Unexpected darknet output: %q: %s", line, err)
+				unknown = append(unknown, line)
+				continue
+			}
+			lr.Objects = append(lr.Objects, o)
+			continue
+		}
+		if strings.HasPrefix(line, "CLASS\t") {
+			o, err := parseClassLine(line)
+			if err != nil {
+				log.Printf("Unexpected darknet output: %q: %s", line, err)
+				unknown = append(unknown, line)
+				continue
+			}
+			lr.Objects = append(lr.Objects, o)
+			continue
+		}
+		if m := predictedRegexp.FindStringSubmatch(line); m != nil && m[1] == imgPath {
+			t, err := strconv.ParseFloat(m[2], 64)
+			if err != nil {
+				log.Printf("Unexpected darknet output: %q: %s", line, err)
+				unknown = append(unknown, line)
+				continue
+			}
+			if m[3] == "milli-seconds" {
+				t = t / 1000
+			}
+			lr.TimeDetect = t
+			continue
+		}
+		for _, re := range noise {
+			if re.MatchString(line) {
+				continue lines
+			}
+		}
+		log.Printf("Unexpected darknet output: %q", line)
+		unknown = append(unknown, line)
+	}
+	return lr, unknown
+}
+
+// parseClassLine parses the line printed by the etc/darknet-patches patches:
+// "CLASS\t<name>\t<prob>\tBBOX\t<left> <right> <top> <bot>". Class names may contain spaces.
+func parseClassLine(line string) (Object, error) {
+	o := Object{}
+	fields := strings.Split(line, "\t")
+	if len(fields) != 5 || fields[3] != "BBOX" {
+		return o, fmt.Errorf("expected 5 tab separated fields")
+	}
+	o.Class = fields[1]
+	var err error
+	o.Prob, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return o, err
+	}
+	bbox := strings.Fields(fields[4])
+	if len(bbox) != 4 {
+		return o, fmt.Errorf("expected 4 BBOX coordinates")
+	}
+	for i, v := range []*int{&o.Left, &o.Right, &o.Top, &o.Bot} {
+		*v, err = strconv.Atoi(bbox[i])
+		if err != nil {
+			return o, err
+		}
+	}
+	return o, nil
+}
+
+// parseExtOutput converts a stock AlexeyAB -ext_output match, such as
+// "dog: 98%\t(left_x:  129   top_y:  225   width:  184   height:  317)",
+// to the left/right/top/bot edges the patched forks print, clamped to bounds
+// when the image size is known.
+func parseExtOutput(m []string, bounds image.Rectangle) (Object, error) {
+	o := Object{Class: m[1]}
+	var x, y, w, h int
+	var err error
+	for i, v := range []*int{&o.Prob, &x, &y, &w, &h} {
+		*v, err = strconv.Atoi(m[i+2])
+		if err != nil {
+			return o, err
+		}
+	}
+	o.Left, o.Right, o.Top, o.Bot = x, x+w, y, y+h
+	if o.Left < 0 {
+		o.Left = 0
+	}
+	if o.Top < 0 {
+		o.Top = 0
+	}
+	if !bounds.Empty() {
+		if o.Right > bounds.Dx()-1 {
+			o.Right = bounds.Dx() - 1
+		}
+		if o.Bot > bounds.Dy()-1 {
+			o.Bot = bounds.Dy() - 1
+		}
+	}
+	return o, nil
+}
+
+// imageBounds returns the size of the image at path, or an empty rectangle if
+// it can't be decoded.
+func imageBounds(path string) image.Rectangle {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Rectangle{}
+	}
+	defer f.Close()
+	c, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Rectangle{}
+	}
+	return image.Rect(0, 0, c.Width, c.Height)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fixtureOutputs returns the outputs of a fakedarknet fixture for imgPath,
+// split into lines.
+func fixtureOutputs(t *testing.T, name, imgPath string) [][]string {
+	t.Helper()
+	data, err := ioutil.ReadFile(fixture(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := [][]string{}
+	for _, o := range strings.Split(string(data), "---\n") {
+		if strings.TrimSpace(o) != "" {
+			outputs = append(outputs, strings.Split(strings.TrimSuffix(fmt.Sprintf(o, imgPath), "\n"), "\n"))
+		}
+	}
+	return outputs
+}
+
+func TestParsers(t *testing.T) {
+	const imgPath = "/tmp/cap/detect.jpg"
+	person := Object{Class: "person", Prob: 85, Left: 365, Right: 445, Top: 314, Bot: 413}
+	trafficLight := Object{Class: "traffic light", Prob: 71, Left: 20, Right: 44, Top: 10, Bot: 80}
+	car := Object{Class: "car", Prob: 64, Left: 12, Right: 200, Top: 40, Bot: 180}
+	dog := Object{Class: "dog", Prob: 58, Left: 120, Right: 260, Top: 300, Bot: 420}
+	type output struct {
+		objects    []Object
+		timeDetect float64
+		unknown    int
+	}
+	for _, tc := range []struct {
+		fixture string
+		flavor  string
+		want    []output
+	}{
+		{fixture: "nnpack", flavor: "nnpack", want: []output{
+			{objects: []Object{person}, timeDetect: 0.767813},
+			{objects: []Object{{Class: "person", Prob: 79, Left: 370, Right: 449, Top: 310, Bot: 415}, dog}, timeDetect: 0.791220},
+			{timeDetect: 0.702115},
+		}},
+		{fixture: "pjreddie", flavor: "pjreddie", want: []output{
+			{objects: []Object{person, trafficLight}, timeDetect: 0.412035},
+			{timeDetect: 0.398812},
+			{objects: []Object{dog}, timeDetect: 0.401187},
+		}},
+		{fixture: "alexeyab", flavor: "alexeyab", want: []output{
+			{objects: []Object{person, trafficLight}, timeDetect: 0.048213},
+			{timeDetect: 0.047022},
+			{objects: []Object{car}, timeDetect: 0.049561},
+		}},
+		{fixture: "alexeyab-stock", flavor: "alexeyab", want: []output{
+			{objects: []Object{person, trafficLight}, timeDetect: 0.048213},
+			{timeDetect: 0.047022},
+			{objects: []Object{car}, timeDetect: 0.049561},
+		}},
+		// the noise and -ext_output lines are only understood by the alexeyab parser
+		{fixture: "alexeyab", flavor: "pjreddie", want: []output{
+			{objects: []Object{person, trafficLight}, timeDetect: 0.048213, unknown: 1},
+			{timeDetect: 0.047022, unknown: 1},
+			{objects: []Object{car}, timeDetect: 0.049561},
+		}},
+		{fixture: "alexeyab-stock", flavor: "pjreddie", want: []output{
+			{timeDetect: 0.048213, unknown: 2},
+			{timeDetect: 0.047022},
+			{timeDetect: 0.049561, unknown: 1},
+		}},
+	} {
+		outputs := fixtureOutputs(t, tc.fixture, imgPath)
+		if len(outputs) != len(tc.want) {
+			t.Fatalf("%s: expected %d outputs, got %d", tc.fixture, len(tc.want), len(outputs))
+		}
+		for i, lines := range outputs {
+			lr, unknown := darknetFlavors[tc.flavor].parse(imgPath, lines)
+			want := tc.want[i]
+			if !reflect.DeepEqual(lr.Objects, want.objects) {
+				t.Errorf("%s output %d as %s: expected objects %+v, got %+v", tc.fixture, i+1, tc.flavor, want.objects, lr.Objects)
+			}
+			if lr.TimeDetect != want.timeDetect {
+				t.Errorf("%s output %d as %s: expected TimeDetect %v, got %v", tc.fixture, i+1, tc.flavor, want.timeDetect, lr.TimeDetect)
+			}
+			if len(unknown) != want.unknown {
+				t.Errorf("%s output %d as %s: expected %d unknown lines, got %q", tc.fixture, i+1, tc.flavor, want.unknown, unknown)
+			}
+		}
+	}
+}
+
+func TestParseOtherImage(t *testing.T) {
+	lines := []string{
+		"/tmp/cap/other.jpg: Predicted in 0.5 seconds.",
+		"CLASS\tperson\t85\tBBOX\t365 445 314",
+		"CLASS\tperson\tmost\tBBOX\t365 445 314 413",
+	}
+	lr, unknown := parsePjreddieOutput("/tmp/cap/detect.jpg", lines)
+	if lr.TimeDetect != 0 || len(lr.Objects) != 0 || len(unknown) != 3 {
+		t.Errorf("Parsed %+v, unknown %q", lr, unknown)
+	}
+}
+
+func TestDetectFlavor(t *testing.T) {
+	banner, err := ioutil.ReadFile(fixture("alexeyab-banner"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		banner []string
+		want   string
+	}{
+		{name: "alexeyab-banner", banner: strings.Split(string(banner), "\n"), want: "alexeyab"},
+		{name: "pjreddie", banner: []string{"layer     filters    size              input                output", "Loading weights from yolov3-tiny.weights...Done!"}, want: "pjreddie"},
+		{name: "empty", want: "pjreddie"},
+	} {
+		if got := detectFlavor(tc.banner); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+	for _, name := range []string{"pjreddie", "nnpack", "alexeyab", "alexeyab-stock"} {
+		for _, lines := range fixtureOutputs(t, name, "detect.jpg") {
+			if got := detectFlavor(lines); got != "pjreddie" {
+				t.Errorf("%s output detected as %s", name, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IngestResult is returned by PUT /ingest/{camera}.
+type IngestResult struct {
+	Camera string
+	Image  string
+}
+
+// rateLimiter allows each client rate() requests per second, in bursts of up
+// to rate() (at least 1), with a token bucket per client.
+type rateLimiter struct {
+	rate    func() float64
+	mtx     sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate func() float64) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token from client's bucket, returning whether there was one
+// and, if not, how long until there will be.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	rate := l.rate()
+	if rate <= 0 {
+		return true, 0
+	}
+	burst := math.Max(rate, 1)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= ingestMaxClients {
+			l.prune(now, rate, burst)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets the clients whose buckets have refilled, as new clients would
+// start with a full bucket anyway.
+func (l *rateLimiter) prune(now time.Time, rate, burst float64) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// httpIngestHandler accepts a JPEG pushed by a remote capture client, writes
+// it into the camera's archive under a timestamped name, and queues it for
+// detection.
+func (dd *DarknetD) httpIngestHandler(w http.ResponseWriter, r *http.Request) {
+	cam, ok := dd.requestCamera(w, r, "/ingest", nil)
+	if !ok {
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if ok, wait := dd.ingestLimiter.allow(client, time.Now()); !ok {
+		e := fmt.Errorf("Rate limit exceeded for %s", client)
+		fmt.Println(e)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, e.Error(), http.StatusTooManyRequests)
+		dd.metrics.ApiErrors.WithLabelValues("/ingest", "RateLimited").Add(1)
+		return
+	}
+	maxBytes := dd.currentConfig().ingestMaxBytes
+	if r.ContentLength > maxBytes {
+		e := fmt.Errorf("Image too large: %d bytes, limit %d", r.ContentLength, maxBytes)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusRequestEntityTooLarge)
+		dd.metrics.ApiErrors.WithLabelValues("/ingest", "TooLarge").Add(1)
+		return
+	}
+	img, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		e := fmt.Errorf("Error reading upload: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/ingest", "Upload").Add(1)
+		return
+	}
+	if int64(len(img)) > maxBytes {
+		e := fmt.Errorf("Image too large: over %d bytes", maxBytes)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusRequestEntityTooLarge)
+		dd.metrics.ApiErrors.WithLabelValues("/ingest", "TooLarge").Add(1)
+		return
+	}
+	if contentType := http.DetectContentType(img); contentType != "image/jpeg" {
+		e := fmt.Errorf("Unsupported image type: %s", contentType)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusUnsupportedMediaType)
+		dd.metrics.ApiErrors.WithLabelValues("/ingest", "ImageType").Add(1)
+		return
+	}
+	if !isCompleteJPEG(img) {
+		e := fmt.Errorf("Incomplete JPEG: missing EOI marker")
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/ingest", "Incomplete").Add(1)
+		return
+	}
+
+	name, err := archiveImage(cam.ArchiveDir, img, time.Now())
+	if err != nil {
+		e := fmt.Errorf("Error storing upload: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/ingest", "WriteFile").Add(1)
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(cam.CaptureDir, cam.CaptureFile), img); err != nil {
+		log.Printf("Camera %s: error saving capture file: %s", cam.Name, err)
+	}
+	dd.imageReady(cam, name)
+	cam.ingested.Add(1)
+	result := IngestResult{Camera: cam.Name, Image: name}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		e := fmt.Errorf("Result processing error: %s", err)
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/ingest", "json.Marshal").Add(1)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, string(out))
+	dd.metrics.ApiRequests.WithLabelValues("/ingest").Add(1)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// ingest pushes img to camera, returning the response.
+func (td *testDaemon) ingest(camera, img string) (*http.Response, string) {
+	td.t.Helper()
+	req, err := http.NewRequest("PUT", td.server.URL+"/ingest/"+camera, strings.NewReader(img))
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestIngest(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	dir := newTestDir(t)
+	writeFile(t, filepath.Join(dir, "ingest.yaml"), "ingest-max-bytes: 100\ningest-rate: 2\n")
+	td := startTestDaemon(t, dir, "--config=DIR/ingest.yaml")
+	img := fakeJPEG("push.jpg")
+	status := func(camera, img string) int {
+		resp, _ := td.ingest(camera, img)
+		return resp.StatusCode
+	}
+
+	resp, body := td.ingest("default", img)
+	result := IngestResult{}
+	if err := json.Unmarshal([]byte(body), &result); resp.StatusCode != http.StatusAccepted || err != nil {
+		t.Fatalf("/ingest: %d %s", resp.StatusCode, body)
+	}
+	if !regexp.MustCompile(`^image-[0-9]{8}-[0-9]{6}\.[0-9]{3}\.jpg$`).MatchString(result.Image) || result.Camera != "default" {
+		t.Errorf("/ingest returned %+v", result)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "archive", result.Image)); err != nil || string(data) != img {
+		t.Errorf("Pushed image not archived: %v", err)
+	}
+	td.waitForImage("/objects", result.Image)
+	if n := testutil.ToFloat64(td.metrics.IngestedImages.WithLabelValues("default")); n != 1 {
+		t.Errorf("Expected 1 pushed image counted, got %v", n)
+	}
+	if s := status("nope", img); s != http.StatusNotFound {
+		t.Errorf("/ingest to unknown camera: %d", s)
+	}
+	if s := status("default", "not an image"); s != http.StatusUnsupportedMediaType {
+		t.Errorf("/ingest accepted text: %d", s)
+	}
+
+	time.Sleep(time.Second)
+	if s := status("default", "\xff\xd8\xff\xe0cut off"); s != http.StatusBadRequest {
+		t.Errorf("/ingest accepted an incomplete JPEG: %d", s)
+	}
+	if s := status("default", "\xff\xd8\xff\xe0"+strings.Repeat("x", 200)+"\xff\xd9"); s != http.StatusRequestEntityTooLarge {
+		t.Errorf("/ingest accepted an image over ingest-max-bytes: %d", s)
+	}
+
+	time.Sleep(time.Second)
+	codes := map[int]int{}
+	for n := 0; n < 4; n++ {
+		codes[status("default", img)]++
+	}
+	if codes[http.StatusAccepted] != 2 || codes[http.StatusTooManyRequests] != 2 {
+		t.Errorf("/ingest rate limit returned %v", codes)
+	}
+	if resp, _ := td.ingest("default", img); resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("/ingest returned Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			t.Errorf("Temporary pushed image %s left in the archive", f.Name())
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// backlogPolicy decides which of the images that arrive while darknet is busy
+// are detected: only the newest (latest-only), all of them in order (all), or
+// every Nth one in order (sample-every-N).
+type backlogPolicy struct {
+	name  string
+	every int
+}
+
+// parseBacklog parses a --backlog policy.
+func parseBacklog(s string) (backlogPolicy, error) {
+	switch s {
+	case "latest-only", "all":
+		return backlogPolicy{name: s, every: 1}, nil
+	}
+	if n := strings.TrimPrefix(s, "sample-every-"); n != s {
+		if every, err := strconv.Atoi(n); err == nil && every >= 1 {
+			return backlogPolicy{name: s, every: every}, nil
+		}
+	}
+	return backlogPolicy{}, fmt.Errorf("must be latest-only, all or sample-every-N")
+}
+
+// imageQueue holds a camera's images waiting for detection, oldest first.
+// Each image is queued once, by name: images already queued or detected are
+// remembered until they leave the archive.
+type imageQueue struct {
+	mtx     sync.Mutex
+	policy  backlogPolicy
+	images  []string
+	seen    map[string]bool
+	arrived int  // images seen, for sampling
+	scanned bool // archive scanned at least once, when polling
+	depth   prometheus.Gauge
+	dropped *prometheus.CounterVec // by reason
+}
+
+func newImageQueue(policy backlogPolicy, depth prometheus.Gauge, dropped *prometheus.CounterVec) *imageQueue {
+	return &imageQueue{
+		policy:  policy,
+		seen:    map[string]bool{},
+		depth:   depth,
+		dropped: dropped,
+	}
+}
+
+// setPolicy applies a reloaded policy to the images that arrive from now on.
+func (q *imageQueue) setPolicy(policy backlogPolicy) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.policy = policy
+}
+
+// push queues the named image according to the policy, unless it has been
+// seen before. It returns whether the image was queued.
+func (q *imageQueue) push(name string) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.pushLocked(name)
+}
+
+func (q *imageQueue) pushLocked(name string) bool {
+	if q.seen[name] {
+		return false
+	}
+	q.seen[name] = true
+	q.arrived++
+	defer func() { q.depth.Set(float64(len(q.images))) }()
+	switch q.policy.name {
+	case "latest-only":
+		q.drop("stale", len(q.images))
+		q.images = q.images[:0]
+	case "all":
+	default:
+		if (q.arrived-1)%q.policy.every != 0 {
+			q.drop("sampled", 1)
+			return false
+		}
+	}
+	if len(q.images) >= queueMaxImages {
+		q.drop("overflow", 1)
+		q.images = q.images[1:]
+	}
+	q.images = append(q.images, name)
+	return true
+}
+
+// pop returns the oldest queued image, or "" if there is none.
+func (q *imageQueue) pop() string {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.images) == 0 {
+		return ""
+	}
+	name := q.images[0]
+	q.images = q.images[1:]
+	q.depth.Set(float64(len(q.images)))
+	return name
+}
+
+func (q *imageQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.images)
+}
+
+// forget drops the named image, removed from the archive, from the queue
+// and from the images seen.
+func (q *imageQueue) forget(name string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.forgetLocked(name)
+}
+
+func (q *imageQueue) forgetLocked(name string) {
+	delete(q.seen, name)
+	for i, n := range q.images {
+		if n == name {
+			q.images = append(q.images[:i], q.images[i+1:]...)
+			q.drop("removed", 1)
+			q.depth.Set(float64(len(q.images)))
+			return
+		}
+	}
+}
+
+// scan queues the images in dir that haven't been seen, oldest first, and
+// forgets the ones no longer there. Incomplete images are left for a later
+// scan. The first scan only queues the newest image, like the archive watcher.
+func (q *imageQueue) scan(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	images := []string{}
+	modTimes := map[string]int64{}
+	for _, f := range files {
+		if f.IsDir() || !isArchiveImage(f.Name()) {
+			continue
+		}
+		present[f.Name()] = true
+		images = append(images, f.Name())
+		modTimes[f.Name()] = f.ModTime().UnixNano()
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if modTimes[images[i]] != modTimes[images[j]] {
+			return modTimes[images[i]] < modTimes[images[j]]
+		}
+		return images[i] < images[j]
+	})
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for name := range q.seen {
+		if !present[name] {
+			q.forgetLocked(name)
+		}
+	}
+	if !q.scanned && len(images) > 0 {
+		for _, name := range images[:len(images)-1] {
+			q.seen[name] = true
+		}
+		images = images[len(images)-1:]
+	}
+	q.scanned = true
+	for _, name := range images {
+		if q.seen[name] {
+			continue
+		}
+		// picked up on a later scan once the capture tool has finished it
+		if complete, err := jpegComplete(filepath.Join(dir, name)); err != nil || !complete {
+			continue
+		}
+		q.pushLocked(name)
+	}
+	return nil
+}
+
+func (q *imageQueue) drop(reason string, n int) {
+	if n > 0 {
+		q.dropped.WithLabelValues(reason).Add(float64(n))
+	}
+}
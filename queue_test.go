@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// dropped returns the number of the default camera's images dropped for reason.
+func (td *testDaemon) dropped(reason string) int {
+	return int(testutil.ToFloat64(td.metrics.DroppedImages.WithLabelValues("default", reason)))
+}
+
+func TestQueueDepth(t *testing.T) {
+	depth := prometheus.NewGauge(prometheus.GaugeOpts{Name: "depth"})
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dropped"}, []string{"reason"})
+	policy, err := parseBacklog("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newImageQueue(policy, depth, dropped)
+	for n, name := range []string{"image1.jpg", "image2.jpg"} {
+		q.push(name)
+		if d := testutil.ToFloat64(depth); d != float64(n+1) {
+			t.Errorf("Depth %v after pushing %s", d, name)
+		}
+	}
+	q.pop()
+	if d := testutil.ToFloat64(depth); d != 1 {
+		t.Errorf("Depth %v after pop", d)
+	}
+}
+
+func TestBacklogLatestOnly(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	t.Setenv("FAKEDARKNET_DELAY", "600ms")
+	td := startTestDaemon(t, newTestDir(t), "--backlog=latest-only")
+
+	td.capture("image1.jpg")
+	time.Sleep(300 * time.Millisecond)
+	for n := 2; n <= 4; n++ {
+		td.capture(fmt.Sprintf("image%d.jpg", n))
+	}
+	td.waitForImage("/objects", "image4.jpg")
+	if n := td.detections("default", "yolov3-tiny"); n != 2 {
+		t.Errorf("Expected 2 detections, got %d", n)
+	}
+	if n := td.dropped("stale"); n != 2 {
+		t.Errorf("Expected 2 stale images dropped, got %d", n)
+	}
+}
+
+func TestBacklogAll(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	t.Setenv("FAKEDARKNET_DELAY", "200ms")
+	td := startTestDaemon(t, newTestDir(t), "--backlog=all")
+
+	want := []string{}
+	for n := 1; n <= 6; n++ {
+		name := fmt.Sprintf("image%d.jpg", n)
+		td.capture(name)
+		want = append(want, name)
+	}
+	waitFor(t, "6 detections", func() bool { return td.detections("default", "yolov3-tiny") >= 6 })
+	time.Sleep(300 * time.Millisecond)
+	got := []string{}
+	for _, lr := range td.objects("") {
+		got = append(got, lr.Image)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Images not detected once each in order: %v", got)
+	}
+	if n := testutil.ToFloat64(td.metrics.QueuedImages.WithLabelValues("default")); n != 0 {
+		t.Errorf("%v images left queued", n)
+	}
+}
+
+func TestBacklogSample(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	t.Setenv("FAKEDARKNET_DELAY", "200ms")
+	td := startTestDaemon(t, newTestDir(t), "--backlog=sample-every-2")
+
+	for n := 1; n <= 6; n++ {
+		td.capture(fmt.Sprintf("image%d.jpg", n))
+	}
+	td.waitForImage("/objects", "image5.jpg")
+	time.Sleep(500 * time.Millisecond)
+	if n := td.detections("default", "yolov3-tiny"); n != 3 {
+		t.Errorf("Expected 3 detections, got %d", n)
+	}
+	if n := td.dropped("sampled"); n != 3 {
+		t.Errorf("Expected 3 images sampled out, got %d", n)
+	}
+	if _, ok := findImage(td.objects(""), "image2.jpg"); ok {
+		t.Errorf("image2.jpg detected")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// ReloadResult is returned by /admin/reload. RestartRequired lists the
+// changed settings that only take effect when darknetd is restarted.
+type ReloadResult struct {
+	DarknetRestarted bool
+	RestartRequired  []string `json:",omitempty"`
+}
+
+// reload re-reads the command line and config file, and applies the new
+// config if it is valid. Delays, timeouts, retention, tracking, zones, lines,
+// webhooks, camera weights, backlog policies and motion settings apply right
+// away; a new model or darknet setting restarts darknet. On error the running
+// config is left untouched.
+func (dd *DarknetD) reload() (ReloadResult, error) {
+	dd.reloadmtx.Lock()
+	defer dd.reloadmtx.Unlock()
+	result := ReloadResult{}
+	c, err := getConfig(dd.currentConfig().argv)
+	if err != nil {
+		log.Printf("Error reloading config: %s", err)
+		dd.metrics.ConfigReloads.WithLabelValues("failed").Add(1)
+		return result, err
+	}
+	old := dd.currentConfig()
+
+	// settings only read at startup are kept, and reported until restarted
+	if c.listenAddr != old.listenAddr {
+		result.RestartRequired = append(result.RestartRequired, "--listen-addr")
+		c.listenAddr = old.listenAddr
+	}
+	if c.historyFile != old.historyFile {
+		result.RestartRequired = append(result.RestartRequired, "--history-file")
+		c.historyFile = old.historyFile
+	}
+	if c.mqtt != old.mqtt {
+		result.RestartRequired = append(result.RestartRequired, "--mqtt-*")
+		c.mqtt = old.mqtt
+	}
+	if c.pickup != old.pickup {
+		result.RestartRequired = append(result.RestartRequired, "--pickup")
+		c.pickup = old.pickup
+	}
+	if !sameCameras(c.cameras, old.cameras) {
+		result.RestartRequired = append(result.RestartRequired, "cameras")
+	}
+	// models switched by PUT /admin/model keep running unless the models
+	// loaded from the options or files changed
+	modelsChanged := !sameModels(c.loadedModels, old.loadedModels)
+	if !modelsChanged {
+		c.models = old.models
+	}
+	restartDarknet := c.darknetDir != old.darknetDir ||
+		modelsChanged ||
+		c.modelsParallel != old.modelsParallel ||
+		c.darknetFlavor != old.darknetFlavor ||
+		c.darknetStartTimeout != old.darknetStartTimeout
+
+	dd.configmtx.Lock()
+	for _, cam := range dd.cameras {
+		for _, cc := range c.cameras {
+			if cc.Name == cam.Name {
+				cam.Weight = cc.Weight
+				cam.Backlog = cc.Backlog
+				cam.Interval = cc.Interval
+				cam.interval = cc.interval
+				cam.MotionMask = cc.MotionMask
+				cam.motionMask = cc.motionMask
+				cam.ArchiveFiles = cc.ArchiveFiles
+				cam.Zones = cc.Zones
+				cam.Lines = cc.Lines
+			}
+		}
+	}
+	c.cameras = old.cameras
+	dd.config = c
+	dd.configmtx.Unlock()
+
+	for _, cam := range dd.cameras {
+		policy, _ := parseBacklog(cam.Backlog)
+		cam.queue.setPolicy(policy)
+		cam.motion.configure(c.motionThreshold, c.motionHeartbeat, cam.motionMask)
+		cam.tracker.configure(c.trackIoU, c.trackMaxAge)
+		cam.zones.set(cam.Zones)
+		cam.lines.set(cam.Lines)
+		cam.logSettings()
+	}
+	dd.notifier.setRules(c.webhooks)
+	if restartDarknet {
+		dd.requestRestart()
+		result.DarknetRestarted = true
+	}
+	dd.metrics.ConfigReloads.WithLabelValues("ok").Add(1)
+	log.Printf("Reloaded config")
+	if len(result.RestartRequired) > 0 {
+		log.Printf("Restart darknetd to apply: %s", strings.Join(result.RestartRequired, ", "))
+	}
+	return result, nil
+}
+
+// sameCameras reports whether a and b are the same cameras, reading from the
+// same directories and URLs.
+func sameCameras(a, b []CameraConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].CaptureDir != b[i].CaptureDir ||
+			a[i].CaptureFile != b[i].CaptureFile || a[i].ArchiveDir != b[i].ArchiveDir ||
+			a[i].URL != b[i].URL {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadOnSignal reloads the config whenever darknetd receives SIGHUP.
+func (dd *DarknetD) reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("Reloading config on SIGHUP")
+			dd.reload() // logs its own errors
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReload(t *testing.T) {
+	dir := newTestDir(t)
+	config := filepath.Join(dir, "reload.yaml")
+	writeFile(t, config, "track-iou: 0\n")
+	td := startTestDaemon(t, dir, "--config=DIR/reload.yaml")
+	reload := func() (int, ReloadResult) {
+		status, out := td.do("POST", "/admin/reload", "", "")
+		result := ReloadResult{}
+		if status == http.StatusOK {
+			if err := json.Unmarshal([]byte(out), &result); err != nil {
+				t.Fatalf("/admin/reload: %s: %s", err, out)
+			}
+		}
+		return status, result
+	}
+	reloads := func(status string) float64 {
+		return testutil.ToFloat64(td.metrics.ConfigReloads.WithLabelValues(status))
+	}
+
+	if status, _ := td.get("/tracks"); status != http.StatusNotFound {
+		t.Errorf("/tracks with tracking disabled: %d", status)
+	}
+	writeFile(t, config, "track-iou: 0.3\n")
+	if status, result := reload(); status != http.StatusOK || result.DarknetRestarted {
+		t.Errorf("/admin/reload: %d %+v", status, result)
+	}
+	if status, _ := td.get("/tracks"); status != http.StatusOK {
+		t.Errorf("/tracks after enabling tracking: %d", status)
+	}
+
+	writeFile(t, config, "track-iou: 2\n")
+	if status, _ := reload(); status != http.StatusBadRequest {
+		t.Errorf("Invalid reload: %d", status)
+	}
+	if n := reloads("failed"); n != 1 {
+		t.Errorf("Expected 1 failed reload, got %v", n)
+	}
+	if status, _ := td.get("/tracks"); status != http.StatusOK {
+		t.Errorf("/tracks after a failed reload: %d", status)
+	}
+
+	writeFile(t, filepath.Join(dir, "darknet", "other.weights"), "")
+	writeFile(t, config, "track-iou: 0.3\nmodel-weights: other.weights\nmqtt-topic: other\n")
+	status, result := reload()
+	want := ReloadResult{DarknetRestarted: true, RestartRequired: []string{"--mqtt-*"}}
+	if status != http.StatusOK || !reflect.DeepEqual(result, want) {
+		t.Errorf("/admin/reload: %d %+v", status, result)
+	}
+	waitFor(t, "darknet to run other.weights", func() bool {
+		state := td.getState()
+		return state.status == DARKNET_RUNNING && state.Model == "other"
+	})
+	if n := testutil.ToFloat64(td.metrics.DarknetRestarts); n != 0 {
+		t.Errorf("Reload counted as %v darknet restarts", n)
+	}
+	if n := reloads("ok"); n != 2 {
+		t.Errorf("Expected 2 reloads, got %v", n)
+	}
+}
+
+func TestReloadKeepsSwitchedModel(t *testing.T) {
+	dir := newTestDir(t)
+	config := filepath.Join(dir, "reload.yaml")
+	writeFile(t, config, "track-iou: 0.3\n")
+	writeFile(t, filepath.Join(dir, "darknet", "night.weights"), "")
+	td := startTestDaemon(t, dir, "--config=DIR/reload.yaml")
+	if status, out := td.do("PUT", "/admin/model", "application/json", `{"Weights": "night.weights"}`); status != http.StatusOK {
+		t.Fatalf("PUT /admin/model: %d %s", status, out)
+	}
+
+	writeFile(t, config, "track-iou: 0.5\n")
+	status, out := td.do("POST", "/admin/reload", "", "")
+	result := ReloadResult{}
+	if err := json.Unmarshal([]byte(out), &result); status != http.StatusOK || err != nil || result.DarknetRestarted {
+		t.Errorf("/admin/reload: %d %s", status, out)
+	}
+	if m := td.getState().Model; m != "night" {
+		t.Errorf("Reload reverted the switched model to %s", m)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// frameSource pulls frames from an IP camera's URL into the camera's archive,
+// as raspistill would write them: a new image every interval, plus the
+// latest frame as the capture file. The URL serves either an MJPEG stream
+// (multipart/x-mixed-replace), of which one frame per interval is kept, or a
+// single JPEG snapshot, fetched every interval. When the connection fails or
+// stalls, the source reconnects with exponential backoff.
+type frameSource struct {
+	name        string
+	url         string
+	captureDir  string
+	captureFile string
+	archiveDir  string
+	interval    func() time.Duration
+	client      *http.Client
+	ctx         context.Context // canceled by close
+	cancel      context.CancelFunc
+	done        chan struct{}
+
+	mtx    sync.Mutex
+	health SourceHealth
+
+	frames     prometheus.Counter
+	errors     *prometheus.CounterVec // by error
+	up         prometheus.Gauge
+	reconnects prometheus.Counter
+}
+
+// SourceHealth is the state of a camera's frame source, returned by /health
+// and /cameras.
+type SourceHealth struct {
+	URL        string
+	Connected  bool
+	Frames     uint64
+	LastFrame  time.Time
+	Reconnects int
+	LastError  string `json:",omitempty"`
+}
+
+// sourceMetrics are a frame source's metrics, labelled by camera.
+type sourceMetrics struct {
+	frames     prometheus.Counter
+	errors     *prometheus.CounterVec
+	up         prometheus.Gauge
+	reconnects prometheus.Counter
+}
+
+// startFrameSource starts pulling frames from cam's URL. interval is called
+// for every frame, so reloaded settings apply.
+func startFrameSource(cam CameraConfig, interval func() time.Duration, m sourceMetrics) *frameSource {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &frameSource{
+		name:        cam.Name,
+		url:         cam.URL,
+		captureDir:  cam.CaptureDir,
+		captureFile: cam.CaptureFile,
+		archiveDir:  cam.ArchiveDir,
+		interval:    interval,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: sourceReadTimeout}).DialContext,
+				ResponseHeaderTimeout: sourceReadTimeout,
+			},
+		},
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		health:     SourceHealth{URL: redactURL(cam.URL)},
+		frames:     m.frames,
+		errors:     m.errors,
+		up:         m.up,
+		reconnects: m.reconnects,
+	}
+	go s.run()
+	log.Printf("Camera %s: pulling frames from %s every %v", s.name, s.health.URL, interval())
+	return s
+}
+
+// close stops pulling frames, waiting for the frame being saved, if any.
+func (s *frameSource) close() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *frameSource) run() {
+	defer close(s.done)
+	delay := sourceRetryDelay
+	for {
+		saved, err := s.pull()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if saved > 0 {
+			delay = sourceRetryDelay
+		}
+		s.mtx.Lock()
+		s.health.Connected = false
+		s.health.LastError = err.Error()
+		s.health.Reconnects++
+		s.mtx.Unlock()
+		s.up.Set(0)
+		s.reconnects.Add(1)
+		log.Printf("Camera %s: error reading %s, reconnecting in %v: %s", s.name, s.health.URL, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return
+		}
+		delay *= 2
+		if delay > sourceMaxRetryDelay {
+			delay = sourceMaxRetryDelay
+		}
+	}
+}
+
+// pull reads frames from the URL until the connection fails, returning the
+// number of frames saved and why it stopped.
+func (s *frameSource) pull() (int, error) {
+	saved := 0
+	for {
+		start := time.Now()
+		ctx, cancel := context.WithCancel(s.ctx)
+		stall := time.AfterFunc(sourceReadTimeout, cancel)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+		if err != nil {
+			cancel()
+			return saved, err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			stall.Stop()
+			cancel()
+			s.errors.WithLabelValues("connect").Add(1)
+			return saved, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			stall.Stop()
+			cancel()
+			s.errors.WithLabelValues("status").Add(1)
+			return saved, fmt.Errorf("Unexpected status %s", resp.Status)
+		}
+		s.connected()
+		mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") {
+			n, err := s.readStream(resp.Body, params["boundary"], stall)
+			resp.Body.Close()
+			stall.Stop()
+			if ctx.Err() != nil {
+				err = fmt.Errorf("Stalled, no frame for %v", sourceReadTimeout)
+			}
+			cancel()
+			return saved + n, err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, sourceMaxFrameSize+1))
+		resp.Body.Close()
+		stall.Stop()
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("Stalled, no frame for %v", sourceReadTimeout)
+		}
+		cancel()
+		if err != nil {
+			s.errors.WithLabelValues("read").Add(1)
+			return saved, err
+		}
+		if s.save(data) {
+			saved++
+		}
+		select {
+		case <-time.After(s.interval() - time.Since(start)):
+		case <-s.ctx.Done():
+			return saved, s.ctx.Err()
+		}
+	}
+}
+
+// readStream saves one frame per interval from an MJPEG stream, discarding
+// the others. Each frame resets the stall timer.
+func (s *frameSource) readStream(body io.Reader, boundary string, stall *time.Timer) (int, error) {
+	if boundary == "" {
+		s.errors.WithLabelValues("read").Add(1)
+		return 0, fmt.Errorf("Missing multipart boundary")
+	}
+	mr := multipart.NewReader(body, boundary)
+	saved := 0
+	var last time.Time
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			s.errors.WithLabelValues("read").Add(1)
+			return saved, fmt.Errorf("Stream ended")
+		}
+		if err != nil {
+			s.errors.WithLabelValues("read").Add(1)
+			return saved, err
+		}
+		stall.Reset(sourceReadTimeout)
+		if time.Since(last) < s.interval() {
+			io.Copy(ioutil.Discard, part)
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(part, sourceMaxFrameSize+1))
+		if err != nil {
+			s.errors.WithLabelValues("read").Add(1)
+			return saved, err
+		}
+		if s.save(data) {
+			saved++
+			last = time.Now()
+		}
+	}
+}
+
+// save writes a frame into the archive under a timestamped name, and as the
+// capture file, renaming each into place so readers never see a partial
+// image. It returns whether the frame was saved; bad frames are skipped.
+func (s *frameSource) save(data []byte) bool {
+	if len(data) > sourceMaxFrameSize {
+		log.Printf("Camera %s: skipping frame over %d bytes", s.name, sourceMaxFrameSize)
+		s.errors.WithLabelValues("too_large").Add(1)
+		return false
+	}
+	if !isCompleteJPEG(data) {
+		log.Printf("Camera %s: skipping frame that isn't a complete JPEG", s.name)
+		s.errors.WithLabelValues("not_jpeg").Add(1)
+		return false
+	}
+	now := time.Now()
+	if _, err := archiveImage(s.archiveDir, data, now); err != nil {
+		log.Printf("Camera %s: error saving frame: %s", s.name, err)
+		s.errors.WithLabelValues("write").Add(1)
+		return false
+	}
+	if err := writeFileAtomic(filepath.Join(s.captureDir, s.captureFile), data); err != nil {
+		log.Printf("Camera %s: error saving capture file: %s", s.name, err)
+		s.errors.WithLabelValues("write").Add(1)
+	}
+	s.mtx.Lock()
+	s.health.Frames++
+	s.health.LastFrame = now
+	s.mtx.Unlock()
+	s.frames.Add(1)
+	return true
+}
+
+func (s *frameSource) connected() {
+	s.mtx.Lock()
+	s.health.Connected = true
+	s.mtx.Unlock()
+	s.up.Set(1)
+}
+
+func (s *frameSource) getHealth() SourceHealth {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.health
+}
+
+// String summarizes the source's health for /health.
+func (h SourceHealth) String() string {
+	last := "no frames yet"
+	if !h.LastFrame.IsZero() {
+		last = fmt.Sprintf("last frame %.1fs ago", time.Since(h.LastFrame).Seconds())
+	}
+	if !h.Connected {
+		return fmt.Sprintf("reconnecting, %s, %d reconnects, last error: %s", last, h.Reconnects, h.LastError)
+	}
+	return fmt.Sprintf("connected, %d frames, %s", h.Frames, last)
+}
+
+// isCompleteJPEG reports whether data starts with a JPEG SOI marker and ends
+// with an EOI marker, ignoring zero and line-ending padding after it.
+func isCompleteJPEG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0xff, 0xd8}) && bytes.HasSuffix(bytes.TrimRight(data, "\x00\r\n"), []byte{0xff, 0xd9})
+}
+
+var archiveNamemtx sync.Mutex
+
+// archiveImage writes data into archiveDir as image-YYYYMMDD-HHMMSS.mmm.jpg,
+// taken at t, with a numeric suffix if that name is taken. It returns the
+// image name.
+func archiveImage(archiveDir string, data []byte, t time.Time) (string, error) {
+	archiveNamemtx.Lock()
+	defer archiveNamemtx.Unlock()
+	base := "image-" + t.Format("20060102-150405.000")
+	name := base + ".jpg"
+	for n := 1; ; n++ {
+		if _, err := os.Stat(filepath.Join(archiveDir, name)); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s-%d.jpg", base, n)
+	}
+	return name, writeFileAtomic(filepath.Join(archiveDir, name), data)
+}
+
+// writeFileAtomic writes data to a dot-prefixed temporary file next to path
+// and renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// redactURL hides the password in rawURL, for logs and the API.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeCamera stands in for an IP camera, serving an MJPEG stream of 20 fake
+// JPEG frames a second at /stream, and the current frame at /snapshot.jpg.
+// While down, it fails requests and ends streams.
+type fakeCamera struct {
+	*httptest.Server
+	down  int32
+	start time.Time
+}
+
+func newFakeCamera(t *testing.T) *fakeCamera {
+	cam := &fakeCamera{start: time.Now()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		if cam.isDown() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		tick := time.NewTicker(time.Second / 20)
+		defer tick.Stop()
+		for !cam.isDown() {
+			data := cam.frame()
+			if _, err := fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n%s\r\n", len(data), data); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-tick.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/snapshot.jpg", func(w http.ResponseWriter, r *http.Request) {
+		if cam.isDown() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		fmt.Fprint(w, cam.frame())
+	})
+	cam.Server = httptest.NewServer(mux)
+	t.Cleanup(cam.Close)
+	return cam
+}
+
+// frame returns a fake JPEG, numbered by the time since the camera started.
+func (cam *fakeCamera) frame() string {
+	return fakeJPEG(fmt.Sprintf("camera frame %d", time.Since(cam.start)/(time.Second/20)))
+}
+
+func (cam *fakeCamera) isDown() bool {
+	return atomic.LoadInt32(&cam.down) == 1
+}
+
+func (cam *fakeCamera) setDown(down bool) {
+	if down {
+		atomic.StoreInt32(&cam.down, 1)
+	} else {
+		atomic.StoreInt32(&cam.down, 0)
+	}
+}
+
+func TestFrameSources(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	cam := newFakeCamera(t)
+	dir := newTestDir(t)
+	writeFile(t, filepath.Join(dir, "cameras.json"), strings.NewReplacer("DIR", dir, "CAMERA", cam.URL).Replace(`[
+		{"Name": "front", "CaptureDir": "DIR/cap", "ArchiveDir": "DIR/archive", "URL": "CAMERA/stream", "Interval": "200ms"},
+		{"Name": "back", "CaptureDir": "DIR/cap2", "ArchiveDir": "DIR/archive2", "URL": "CAMERA/snapshot.jpg", "Interval": "300ms"}
+	]`))
+	td := startTestDaemon(t, dir, "--cameras-file=DIR/cameras.json")
+	frames := func(camera string) float64 {
+		return testutil.ToFloat64(td.metrics.SourceFrames.WithLabelValues(camera))
+	}
+	health := func(camera, status string) func() bool {
+		return func() bool {
+			_, body := td.get("/health")
+			return strings.Contains(body, "camera "+camera+": "+status)
+		}
+	}
+
+	waitFor(t, "front to connect", health("front", "connected"))
+	waitFor(t, "back to connect", health("back", "connected"))
+	waitFor(t, "3 frames from each camera", func() bool { return frames("front") >= 3 && frames("back") >= 3 })
+	for _, camera := range []string{"front", "back"} {
+		waitFor(t, camera+" frames to be detected", func() bool {
+			results := []DarknetResult{}
+			td.getJSON("/cameras/"+camera+"/objects", &results)
+			return len(results) > 0 && strings.HasPrefix(results[0].Image, "image-") && results[0].Camera == camera
+		})
+	}
+	if _, body := td.get("/cameras/front/latest.jpg"); !strings.Contains(body, "camera frame") {
+		t.Errorf("/cameras/front/latest.jpg is not a camera frame: %q", body)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			t.Errorf("Temporary frame %s left in the archive", f.Name())
+		}
+	}
+	before := frames("front")
+	time.Sleep(time.Second)
+	if n := frames("front") - before; n > 6 {
+		t.Errorf("front kept %v stream frames in 1s at a 200ms interval", n)
+	}
+	cameras := []CameraStatus{}
+	td.getJSON("/cameras", &cameras)
+	if s := cameras[0].Source; s == nil || s.URL != cam.URL+"/stream" || !s.Connected {
+		t.Errorf("/cameras returned front source %+v", s)
+	}
+
+	cam.setDown(true)
+	waitFor(t, "front to reconnect", health("front", "reconnecting"))
+	if status, _ := td.get("/health"); status != http.StatusOK {
+		t.Errorf("/health with a camera down: %d", status)
+	}
+	waitFor(t, "back to go down", func() bool { return testutil.ToFloat64(td.metrics.SourceUp.WithLabelValues("back")) == 0 })
+	if n := testutil.ToFloat64(td.metrics.SourceReconnects.WithLabelValues("front")); n < 1 {
+		t.Errorf("Reconnects not counted")
+	}
+	cam.setDown(false)
+	waitFor(t, "front to connect again", health("front", "connected"))
+	before = frames("front")
+	waitFor(t, "new frames from front", func() bool { return frames("front") > before })
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Broker fans new detections out to streaming API clients. Each subscriber
+// has a small buffer; when a slow subscriber's buffer is full, new results are
+// dropped for that subscriber rather than stalling the jobs manager.
+type Broker struct {
+	subs    map[*subscriber]bool
+	subsmtx sync.Mutex
+	dropped *prometheus.CounterVec
+}
+
+type subscriber struct {
+	kind   string
+	filter resultFilter
+	ch     chan DarknetResult
+}
+
+func newBroker(dropped *prometheus.CounterVec) *Broker {
+	return &Broker{
+		subs:    map[*subscriber]bool{},
+		dropped: dropped,
+	}
+}
+
+func (b *Broker) Subscribe(kind string, filter resultFilter) *subscriber {
+	s := &subscriber{
+		kind:   kind,
+		filter: filter,
+		ch:     make(chan DarknetResult, streamBufferSize),
+	}
+	b.subsmtx.Lock()
+	defer b.subsmtx.Unlock()
+	b.subs[s] = true
+	return s
+}
+
+func (b *Broker) Unsubscribe(s *subscriber) {
+	b.subsmtx.Lock()
+	defer b.subsmtx.Unlock()
+	delete(b.subs, s)
+}
+
+// Publish sends lr to every subscriber whose filter matches, without blocking.
+func (b *Broker) Publish(lr DarknetResult) {
+	b.subsmtx.Lock()
+	defer b.subsmtx.Unlock()
+	for s := range b.subs {
+		flr, ok := s.filter.apply(lr)
+		if !ok {
+			continue
+		}
+		select {
+		case s.ch <- flr:
+		default:
+			b.dropped.WithLabelValues(s.kind).Add(1)
+		}
+	}
+}
+
+// httpEventsHandler streams detections as Server-Sent Events. Clients that
+// reconnect with Last-Event-ID first receive any recent detections they missed.
+func (dd *DarknetD) httpEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseResultFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/events", "BadParam").Add(1)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		e := fmt.Errorf("Streaming unsupported")
+		fmt.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		dd.metrics.ApiErrors.WithLabelValues("/events", "Flusher").Add(1)
+		return
+	}
+	sub := dd.events.Subscribe("sse", filter)
+	defer dd.events.Unsubscribe(sub)
+	dd.metrics.StreamClients.WithLabelValues("sse").Inc()
+	defer dd.metrics.StreamClients.WithLabelValues("sse").Dec()
+	dd.metrics.ApiRequests.WithLabelValues("/events").Add(1)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if lastID > 0 {
+		for _, lr := range dd.recentDetections(nil) {
+			if lr, ok := filter.apply(lr); ok && lr.ID > lastID {
+				if err := writeEvent(w, lr); err != nil {
+					return
+				}
+				lastID = lr.ID
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case lr := <-sub.ch:
+			if lr.ID <= lastID {
+				continue // already sent while catching up
+			}
+			if err := writeEvent(w, lr); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, lr DarknetResult) error {
+	out, err := json.Marshal(lr)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: detection\ndata: %s\n\n", lr.ID, out)
+	return err
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// httpWebsocketHandler streams detections as JSON WebSocket text messages.
+func (dd *DarknetD) httpWebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseResultFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		dd.metrics.ApiErrors.WithLabelValues("/ws", "BadParam").Add(1)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %s", err)
+		dd.metrics.ApiErrors.WithLabelValues("/ws", "Upgrade").Add(1)
+		return
+	}
+	defer conn.Close()
+	sub := dd.events.Subscribe("websocket", filter)
+	defer dd.events.Unsubscribe(sub)
+	dd.metrics.StreamClients.WithLabelValues("websocket").Inc()
+	defer dd.metrics.StreamClients.WithLabelValues("websocket").Dec()
+	dd.metrics.ApiRequests.WithLabelValues("/ws").Add(1)
+
+	// The read loop handles pings and notices when the client goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadDeadline(time.Now().Add(streamHeartbeat * 2))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(streamHeartbeat * 2))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case lr := <-sub.ch:
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteJSON(lr); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
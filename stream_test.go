@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// readEvents reads server-sent detections from GET path for d.
+func (td *testDaemon) readEvents(path, lastEventID string, d time.Duration) []DarknetResult {
+	td.t.Helper()
+	req, err := http.NewRequest("GET", td.server.URL+path, nil)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := (&http.Client{Timeout: d}).Do(req)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		td.t.Fatalf("GET %s: Content-Type %s", path, ct)
+	}
+	results := []DarknetResult{}
+	event := ""
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "detection":
+			lr := DarknetResult{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &lr); err != nil {
+				td.t.Fatalf("Bad event %s: %s", line, err)
+			}
+			results = append(results, lr)
+		}
+	}
+	return results
+}
+
+func TestEvents(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	td := startTestDaemon(t, newTestDir(t))
+	td.capture("image1.jpg")
+	td.waitForImage("/objects", "image1.jpg")
+
+	if _, ok := findImage(td.readEvents("/events", "1", 500*time.Millisecond), "image1.jpg"); !ok {
+		t.Errorf("/events did not replay image1.jpg after Last-Event-ID")
+	}
+	if results := td.readEvents("/events", "", 500*time.Millisecond); len(results) != 0 {
+		t.Errorf("/events replayed %+v without Last-Event-ID", results)
+	}
+
+	td.timelapse()
+	results := td.readEvents("/events?class=dog", "", 2*time.Second)
+	if len(results) == 0 {
+		t.Fatalf("/events sent no detections")
+	}
+	for _, lr := range results {
+		if hasObject([]DarknetResult{lr}, "person") {
+			t.Errorf("/events class filter sent %+v", lr)
+		}
+	}
+}
+
+// dialWebsocket connects to the /ws stream with query.
+func (td *testDaemon) dialWebsocket(query string) *websocket.Conn {
+	td.t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(td.server.URL, "http")+"/ws"+query, nil)
+	if err != nil {
+		td.t.Fatalf("Dial /ws%s: %s", query, err)
+	}
+	resp.Body.Close()
+	td.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitForStreams waits for n WebSocket clients to be subscribed.
+func (td *testDaemon) waitForStreams(n int) {
+	td.t.Helper()
+	waitFor(td.t, fmt.Sprintf("%d WebSocket clients", n), func() bool {
+		return testutil.ToFloat64(td.metrics.StreamClients.WithLabelValues("websocket")) == float64(n)
+	})
+}
+
+// readUntil reads detections from conn up to the one with ID last, returning
+// the images of those before it.
+func readUntil(conn *websocket.Conn, last uint64) ([]string, error) {
+	images := []string{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		lr := DarknetResult{}
+		if err := conn.ReadJSON(&lr); err != nil {
+			return images, err
+		}
+		if lr.ID == last {
+			return images, nil
+		}
+		images = append(images, lr.Image)
+	}
+}
+
+func TestWebsocketFilters(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t))
+	if _, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(td.server.URL, "http")+"/ws?minprob=high", nil); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("/ws?minprob=high not rejected")
+	}
+	clients := map[string]*websocket.Conn{}
+	for _, query := range []string{"?camera=back", "?class=dog", "?minprob=80"} {
+		clients[query] = td.dialWebsocket(query)
+	}
+	td.waitForStreams(len(clients))
+
+	person := Object{Class: "person", Prob: 85}
+	dog := Object{Class: "dog", Prob: 58}
+	td.events.Publish(DarknetResult{ID: 1, Camera: "front", Image: "front-person.jpg", Objects: []Object{person}})
+	td.events.Publish(DarknetResult{ID: 2, Camera: "back", Image: "back-dog.jpg", Objects: []Object{dog}})
+	td.events.Publish(DarknetResult{ID: 3, Camera: "front", Image: "front-both.jpg", Objects: []Object{person, dog}})
+	td.events.Publish(DarknetResult{ID: 4, Camera: "back", Image: "end.jpg", Objects: []Object{{Class: "dog", Prob: 90}}})
+
+	for query, want := range map[string][]string{
+		"?camera=back": {"back-dog.jpg"},
+		"?class=dog":   {"back-dog.jpg", "front-both.jpg"},
+		"?minprob=80":  {"front-person.jpg", "front-both.jpg"},
+	} {
+		if got, err := readUntil(clients[query], 4); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("/ws%s sent %v: %v", query, got, err)
+		}
+	}
+}
+
+func TestWebsocketSlowConsumer(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t))
+	slow := td.dialWebsocket("")
+	td.waitForStreams(1)
+
+	// big enough to fill the socket buffers of a client that doesn't read
+	objects := make([]Object, 200)
+	for i := range objects {
+		objects[i] = Object{Class: "person", Prob: 85}
+	}
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for id := uint64(1); id <= 2000; id++ {
+			td.events.Publish(DarknetResult{ID: id, Image: "flood.jpg", Objects: objects})
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Publish blocked on a slow WebSocket client")
+	}
+	if n := testutil.ToFloat64(td.metrics.StreamDropped.WithLabelValues("websocket")); n == 0 {
+		t.Errorf("No results dropped for the slow client")
+	}
+
+	// the slow client catches up and is still subscribed; the end result is
+	// published until there is room for it
+	read := make(chan []string)
+	go func() {
+		got, err := readUntil(slow, 2001)
+		if err != nil {
+			t.Errorf("Reading /ws: %s", err)
+		}
+		read <- got
+	}()
+	for {
+		td.events.Publish(DarknetResult{ID: 2001, Image: "end.jpg"})
+		select {
+		case got := <-read:
+			if len(got) >= 2000 {
+				t.Errorf("Slow client got all %d results", len(got))
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
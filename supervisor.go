@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// startSupervisor runs darknet in the background, restarting it with
+// exponential backoff whenever the process exits or a job reports a failure.
+// The jobs manager pauses while darknet is not running. A restart requested
+// with requestRestart, e.g. for a reloaded model, is neither delayed nor
+// counted. A model switch, see switchModel, replaces the running detector
+// without a restart. The supervisor stops darknet and returns once dd.quit is
+// closed.
+func (dd *DarknetD) startSupervisor() error {
+	dd.workers.Add(1)
+	go func() {
+		defer dd.workers.Done()
+		delay := darknetRestartDelay
+		for {
+			dd.setStatus(DARKNET_STARTING, nil)
+			config := dd.currentConfig()
+			detector := dd.newDetector(config)
+			err := detector.Start()
+			if err != nil {
+				detector.Close()
+				log.Printf("Error starting darknet, trying again in %v: %s", delay, err)
+				dd.setStatus(DARKNET_STOPPED, err)
+				if !dd.sleep(delay) {
+					return
+				}
+				delay = nextRestartDelay(delay)
+				continue
+			}
+			started := dd.useDetector(detector, config.models)
+			dd.setStatus(DARKNET_RUNNING, nil)
+
+			var reason error
+			requested := false
+		wait:
+			for {
+				select {
+				case <-detector.Done():
+					reason = detector.Err()
+					select { // stopped by detect, which says why
+					case err := <-dd.failures:
+						reason = err
+					default:
+					}
+					break wait
+				case err := <-dd.failures:
+					reason = err
+					break wait
+				case <-dd.restarts:
+					requested = true
+					break wait
+				case <-dd.quit:
+					dd.cmdmtx.Lock()
+					dd.stopDetector()
+					dd.cmdmtx.Unlock()
+					dd.setStatus(DARKNET_STOPPED, nil)
+					return
+				case sw := <-dd.switches:
+					dd.configmtx.Lock()
+					dd.config.models = sw.models
+					dd.configmtx.Unlock()
+					detector = sw.detector
+					started = dd.useDetector(detector, sw.models)
+					log.Printf("Switched to models %s", modelNames(sw.models))
+					close(sw.done)
+				}
+			}
+			dd.setStatus(DARKNET_RESTARTING, reason)
+			dd.cmdmtx.Lock()
+			dd.stopDetector()
+			dd.cmdmtx.Unlock()
+			if requested {
+				log.Printf("Restarting darknet with the new config")
+				continue
+			}
+
+			if time.Since(started) > darknetStableTime {
+				delay = darknetRestartDelay
+			}
+			dd.statemtx.Lock()
+			dd.state.Restarts++
+			dd.statemtx.Unlock()
+			dd.metrics.DarknetRestarts.Add(1)
+			log.Printf("Restarting darknet in %v: %s", delay, reason)
+			if !dd.sleep(delay) {
+				return
+			}
+			delay = nextRestartDelay(delay)
+		}
+	}()
+	return nil
+}
+
+// useDetector sends detections to detector, running models, and stops the
+// previous detector, if any. It returns the time detector took over.
+func (dd *DarknetD) useDetector(detector Detector, models []Model) time.Time {
+	dd.cmdmtx.Lock()
+	dd.stopDetector()
+	dd.detector = detector
+	dd.models = models
+	dd.cmdmtx.Unlock()
+
+	select { // drop failures reported against the previous process
+	case <-dd.failures:
+	default:
+	}
+	started := time.Now()
+	dd.statemtx.Lock()
+	dd.state.StartTime = started
+	dd.state.Model = modelNames(models)
+	dd.statemtx.Unlock()
+	dd.metrics.ModelInfo.Reset()
+	for _, m := range models {
+		dd.metrics.ModelInfo.WithLabelValues(m.Name).Set(1)
+	}
+	return started
+}
+
+// requestRestart asks the supervisor to restart darknet right away. It never
+// blocks.
+func (dd *DarknetD) requestRestart() {
+	select {
+	case dd.restarts <- struct{}{}:
+	default:
+	}
+}
+
+// reportFailure asks the supervisor to restart darknet. It never blocks.
+func (dd *DarknetD) reportFailure(err error) {
+	select {
+	case dd.failures <- err:
+	default:
+	}
+}
+
+func (dd *DarknetD) getState() DarknetState {
+	dd.statemtx.RLock()
+	defer dd.statemtx.RUnlock()
+	return dd.state
+}
+
+func (dd *DarknetD) setStatus(status DarknetJobStatus, err error) {
+	dd.statemtx.Lock()
+	dd.state.status = status
+	dd.state.Status = status.String()
+	if err != nil {
+		dd.state.LastError = err.Error()
+	}
+	hooks := dd.statusHooks
+	dd.statemtx.Unlock()
+	dd.metrics.DarknetStatus.Set(float64(status))
+	for _, hook := range hooks {
+		hook(status)
+	}
+}
+
+// onStatus calls hook with the current darknet status, then on every change.
+func (dd *DarknetD) onStatus(hook func(DarknetJobStatus)) {
+	dd.statemtx.Lock()
+	dd.statusHooks = append(dd.statusHooks, hook)
+	status := dd.state.status
+	dd.statemtx.Unlock()
+	hook(status)
+}
+
+// sleep waits for d, returning false if dd.quit is closed first.
+func (dd *DarknetD) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-dd.quit:
+		return false
+	}
+}
+
+func nextRestartDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > darknetMaxRestartDelay {
+		delay = darknetMaxRestartDelay
+	}
+	return delay
+}
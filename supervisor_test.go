@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRestartAfterCrash(t *testing.T) {
+	t.Setenv("FAKEDARKNET_MODE", "crash")
+	t.Setenv("FAKEDARKNET_CRASH_AFTER", "1")
+	td := startTestDaemon(t, newTestDir(t))
+	td.timelapse()
+	waitFor(t, "a darknet restart", func() bool { return testutil.ToFloat64(td.metrics.DarknetRestarts) >= 1 })
+	state := DarknetState{}
+	td.getJSON("/status", &state)
+	if state.Restarts < 1 {
+		t.Errorf("/status returned %+v", state)
+	}
+}
+
+func TestTimeoutOnHungDarknet(t *testing.T) {
+	t.Setenv("FAKEDARKNET_MODE", "slow")
+	td := startTestDaemon(t, newTestDir(t))
+	td.capture("image1.jpg")
+	waitFor(t, "a detection timeout", func() bool { return testutil.ToFloat64(td.metrics.DetectTimeouts) >= 1 })
+	waitFor(t, "a darknet restart", func() bool { return testutil.ToFloat64(td.metrics.DarknetRestarts) >= 1 })
+	if state := td.getState(); !strings.Contains(state.LastError, "timed out") {
+		t.Errorf("Unexpected LastError %q", state.LastError)
+	}
+}
+
+func TestGarbageOutput(t *testing.T) {
+	t.Setenv("FAKEDARKNET_MODE", "garbage")
+	td := startTestDaemon(t, newTestDir(t))
+	td.capture("image1.jpg")
+	waitFor(t, "unknown output", func() bool { return testutil.ToFloat64(td.metrics.UnknownOutput) >= 1 })
+	if status, body := td.get("/health"); status != 200 || body != "OK\n" {
+		t.Errorf("/health after garbage output: %d %q", status, body)
+	}
+}
+
+func TestTimeoutStopsDetector(t *testing.T) {
+	t.Setenv("FAKEDARKNET_MODE", "slow")
+	dir := newTestDir(t)
+	td := startTestDaemon(t, dir)
+	capture(t, dir, "image1.jpg") // outside the archive
+
+	// the supervisor can't restart darknet while cmdmtx is held
+	td.cmdmtx.Lock()
+	_, err := td.detect(filepath.Join(dir, "image1.jpg"), "")
+	derr, ok := err.(detectorError)
+	if !ok || !derr.fatal {
+		t.Errorf("Expected a fatal detectorError, got %v", err)
+	}
+	if td.detector != nil {
+		t.Errorf("Wedged detector still in use after the timeout")
+	}
+	td.cmdmtx.Unlock()
+	waitFor(t, "a darknet restart", func() bool { return testutil.ToFloat64(td.metrics.DarknetRestarts) >= 1 })
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Track follows one object across detections.
+type Track struct {
+	ID        uint64
+	Class     string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Dwell     float64
+	Hits      int
+	Object    Object
+
+	prev *Object // position in the previous detection it was seen in
+}
+
+// TrackEvent reports a track starting (confirmed after trackMinHits
+// detections) or ending (unseen for the max age).
+type TrackEvent struct {
+	TrackID   uint64
+	Class     string
+	Event     string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Dwell     float64
+}
+
+type trackerMetrics struct {
+	started *prometheus.CounterVec
+	ended   *prometheus.CounterVec
+	active  *prometheus.GaugeVec
+	dwell   prometheus.ObserverVec
+}
+
+// Tracker associates objects with tracks across detections, SORT-style but
+// without motion prediction: same-class objects are greedily matched to
+// tracks by bbox IoU, falling back to the nearest centroid within a bbox
+// width for objects that moved too far between frames to overlap.
+type Tracker struct {
+	minIoU  float64
+	maxAge  time.Duration
+	tracks  []*Track
+	ended   []TrackEvent // end events waiting for the next detection
+	lastID  uint64
+	active  map[string]int // confirmed tracks by class, for the metrics
+	mtx     sync.Mutex
+	metrics trackerMetrics
+}
+
+func newTracker(minIoU float64, maxAge time.Duration, metrics trackerMetrics) *Tracker {
+	return &Tracker{
+		minIoU:  minIoU,
+		maxAge:  maxAge,
+		metrics: metrics,
+	}
+}
+
+type trackMatch struct {
+	track  int
+	object int
+	score  float64
+}
+
+// enabled reports whether tracking is on, i.e. minIoU is above 0.
+func (t *Tracker) enabled() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.minIoU > 0
+}
+
+// configure changes the tracker settings, e.g. on reload. Disabling it drops
+// the current tracks.
+func (t *Tracker) configure(minIoU float64, maxAge time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.minIoU = minIoU
+	t.maxAge = maxAge
+	if minIoU > 0 {
+		return
+	}
+	t.tracks = nil
+	t.ended = nil
+	for class := range t.active {
+		t.metrics.active.DeleteLabelValues(class)
+	}
+	t.active = nil
+}
+
+// expire ends the tracks unseen for longer than the max age. The jobs manager
+// calls it between detections too, so tracks end on idle cameras and while
+// motion gating skips frames; their end events go out with the camera's next
+// detection.
+func (t *Tracker) expire(now time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.expireTracks(now) {
+		t.updateActive()
+	}
+}
+
+// expireTracks drops the tracks unseen for longer than the max age, queueing
+// end events for the confirmed ones, and reports whether any were dropped.
+// Callers must hold mtx.
+func (t *Tracker) expireTracks(now time.Time) bool {
+	live := []*Track{}
+	for _, tr := range t.tracks {
+		if now.Sub(tr.LastSeen) > t.maxAge {
+			t.end(tr)
+			continue
+		}
+		live = append(live, tr)
+	}
+	expired := len(live) < len(t.tracks)
+	t.tracks = live
+	return expired
+}
+
+// apply sets TrackID and Dwell on the objects in lr and adds start/end events.
+// It returns the confirmed tracks that moved, i.e. were matched to an object
+// in lr, with their previous positions.
+func (t *Tracker) apply(lr *DarknetResult) []Track {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := lr.PredTime
+
+	// expire tracks first, so their objects can start new ones
+	t.expireTracks(now)
+	lr.TrackEvents = append(lr.TrackEvents, t.ended...)
+	t.ended = nil
+
+	matches := []trackMatch{}
+	for i, tr := range t.tracks {
+		for j, o := range lr.Objects {
+			if o.Class != tr.Class || o.Model != tr.Object.Model {
+				continue
+			}
+			if iou := bboxIoU(tr.Object, o); iou >= t.minIoU {
+				matches = append(matches, trackMatch{i, j, 1 + iou})
+			} else if d := centroidDistance(tr.Object, o); d < float64(tr.Object.Right-tr.Object.Left) {
+				matches = append(matches, trackMatch{i, j, 1 / (1 + d)}) // always ranks below any IoU match
+			}
+		}
+	}
+	sort.Slice(matches, func(a, b int) bool { return matches[a].score > matches[b].score })
+	trackUsed := map[int]bool{}
+	objectUsed := map[int]bool{}
+	assigned := map[*Track]int{}
+	for _, m := range matches {
+		if trackUsed[m.track] || objectUsed[m.object] {
+			continue
+		}
+		trackUsed[m.track] = true
+		objectUsed[m.object] = true
+		tr := t.tracks[m.track]
+		assigned[tr] = m.object
+		prev := tr.Object
+		tr.prev = &prev
+		tr.Object = lr.Objects[m.object]
+		tr.LastSeen = now
+		tr.Dwell = now.Sub(tr.FirstSeen).Seconds()
+		tr.Hits++
+		if tr.Hits == trackMinHits {
+			t.start(lr, tr)
+		}
+	}
+	for j, o := range lr.Objects {
+		if objectUsed[j] {
+			continue
+		}
+		t.lastID++
+		tr := &Track{ID: t.lastID, Class: o.Class, FirstSeen: now, LastSeen: now, Hits: 1, Object: o}
+		t.tracks = append(t.tracks, tr)
+		assigned[tr] = j
+		if tr.Hits == trackMinHits {
+			t.start(lr, tr)
+		}
+	}
+
+	moved := []Track{}
+	for _, tr := range t.tracks {
+		if tr.Hits < trackMinHits {
+			continue
+		}
+		if j, ok := assigned[tr]; ok {
+			lr.Objects[j].TrackID = tr.ID
+			lr.Objects[j].Dwell = tr.Dwell
+			tr.Object = lr.Objects[j]
+			if tr.prev != nil {
+				moved = append(moved, *tr)
+			}
+		}
+	}
+	t.updateActive()
+	return moved
+}
+
+// updateActive sets the active tracks gauge from the confirmed tracks.
+// Callers must hold mtx.
+func (t *Tracker) updateActive() {
+	active := map[string]int{}
+	for _, tr := range t.tracks {
+		if tr.Hits >= trackMinHits {
+			active[tr.Class]++
+		}
+	}
+	for class := range t.active {
+		if _, ok := active[class]; !ok {
+			t.metrics.active.DeleteLabelValues(class)
+		}
+	}
+	for class, n := range active {
+		t.metrics.active.WithLabelValues(class).Set(float64(n))
+	}
+	t.active = active
+}
+
+func (t *Tracker) start(lr *DarknetResult, tr *Track) {
+	lr.TrackEvents = append(lr.TrackEvents, trackEvent(tr, "start"))
+	t.metrics.started.WithLabelValues(tr.Class).Add(1)
+}
+
+func (t *Tracker) end(tr *Track) {
+	if tr.Hits < trackMinHits {
+		return // never confirmed
+	}
+	t.ended = append(t.ended, trackEvent(tr, "end"))
+	t.metrics.ended.WithLabelValues(tr.Class).Add(1)
+	t.metrics.dwell.WithLabelValues(tr.Class).Observe(tr.Dwell)
+}
+
+func trackEvent(tr *Track, event string) TrackEvent {
+	return TrackEvent{
+		TrackID:   tr.ID,
+		Class:     tr.Class,
+		Event:     event,
+		FirstSeen: tr.FirstSeen,
+		LastSeen:  tr.LastSeen,
+		Dwell:     tr.Dwell,
+	}
+}
+
+// Tracks returns the confirmed tracks.
+func (t *Tracker) Tracks() []Track {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	tracks := []Track{}
+	for _, tr := range t.tracks {
+		if tr.Hits >= trackMinHits {
+			tracks = append(tracks, *tr)
+		}
+	}
+	return tracks
+}
+
+func bboxIoU(a, b Object) float64 {
+	w := math.Min(float64(a.Right), float64(b.Right)) - math.Max(float64(a.Left), float64(b.Left))
+	h := math.Min(float64(a.Bot), float64(b.Bot)) - math.Max(float64(a.Top), float64(b.Top))
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	inter := w * h
+	areaA := float64((a.Right - a.Left) * (a.Bot - a.Top))
+	areaB := float64((b.Right - b.Left) * (b.Bot - b.Top))
+	return inter / (areaA + areaB - inter)
+}
+
+func centroidDistance(a, b Object) float64 {
+	ax, ay := anchorPoint(a, "center")
+	bx, by := anchorPoint(b, "center")
+	return math.Hypot(ax-bx, ay-by)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTracking(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	td := startTestDaemon(t, newTestDir(t))
+	td.capture("image1.jpg")
+	td.waitForImage("/objects", "image1.jpg")
+	td.capture("image2.jpg")
+	td.waitForImage("/objects", "image2.jpg")
+
+	tracks := []Track{}
+	td.getJSON("/tracks", &tracks)
+	if len(tracks) != 1 || tracks[0].Class != "person" || tracks[0].Hits != 2 {
+		t.Fatalf("/tracks returned %+v", tracks)
+	}
+	results := td.objects("?class=person")
+	// tracks get an ID once confirmed by a second detection
+	if len(results) != 2 || results[0].Objects[0].TrackID != 0 || results[1].Objects[0].TrackID != tracks[0].ID {
+		t.Fatalf("Unexpected track IDs: %+v", results)
+	}
+	events := results[1].TrackEvents
+	if len(events) != 1 || events[0].Class != "person" || events[0].Event != "start" || events[0].TrackID != results[1].Objects[0].TrackID {
+		t.Errorf("Unexpected track events %+v", events)
+	}
+	if n := testutil.ToFloat64(td.metrics.TracksStarted.WithLabelValues("default", "person")); n != 1 {
+		t.Errorf("Expected 1 person track started, got %v", n)
+	}
+}
+
+func TestTrackingDisabled(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t), "--track-iou=0")
+	if status, _ := td.get("/tracks"); status != 404 {
+		t.Errorf("/tracks with tracking disabled: %d", status)
+	}
+}
+
+func TestTrackExpiry(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	td := startTestDaemon(t, newTestDir(t), "--track-max-age=300")
+	td.capture("image1.jpg")
+	td.waitForImage("/objects", "image1.jpg")
+	td.capture("image2.jpg")
+	td.waitForImage("/objects", "image2.jpg")
+
+	// no more images: the track still ends after the max age
+	waitFor(t, "the track to end", func() bool {
+		tracks := []Track{}
+		td.getJSON("/tracks", &tracks)
+		return len(tracks) == 0
+	})
+	if n := testutil.ToFloat64(td.metrics.TracksEnded.WithLabelValues("default", "person")); n != 1 {
+		t.Errorf("Expected 1 person track ended, got %v", n)
+	}
+	if n := testutil.CollectAndCount(td.metrics.TracksActive); n != 0 {
+		t.Errorf("Expected no active tracks, got %d", n)
+	}
+
+	td.capture("image3.jpg")
+	lr := td.waitForImage("/objects", "image3.jpg")
+	if len(lr.TrackEvents) != 1 || lr.TrackEvents[0].Event != "end" || lr.TrackEvents[0].Class != "person" {
+		t.Errorf("Unexpected track events %+v", lr.TrackEvents)
+	}
+}
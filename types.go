@@ -1,28 +1,48 @@
 package main
 
 import (
-	"io"
 	"sync"
 	"time"
-
-	"github.com/zfjagann/golang-ring"
 )
 
 type DarknetD struct {
-	config  DarknetDConfig
-	metrics Metrics
+	config    DarknetDConfig
+	configmtx sync.RWMutex // guards config and the settings of cameras
+	reloadmtx sync.Mutex
+	metrics   Metrics
 
-	detections    *ring.Ring
 	detectionsmtx sync.RWMutex
+	lastID        uint64
+	history       *History
+	events        *Broker
+	cameras       []*Camera
+	notifier      *Notifier
+	imagesReady   chan struct{}
+	ingestLimiter *rateLimiter
+
+	detector    Detector
+	models      []Model
+	newDetector func(DarknetDConfig) Detector
+	cmdmtx      sync.Mutex
+	switches    chan modelSwitch
+	switchmtx   sync.Mutex
 
-	cmdin  io.WriteCloser
-	cmdout io.ReadCloser
-	cmdmtx sync.Mutex
+	state       DarknetState
+	statemtx    sync.RWMutex
+	statusHooks []func(DarknetJobStatus)
+	failures    chan error
+	restarts    chan struct{}
+
+	publisher *MQTTPublisher
+	quit      chan struct{}  // closed by stop
+	workers   sync.WaitGroup // supervisor and jobs manager
 }
 
 type DarknetDConfig struct {
 	capDir               string
 	capFile              string
+	capURL               string
+	captureInterval      time.Duration
 	listenAddr           string
 	archiveDir           string
 	archiveFiles         int
@@ -33,6 +53,34 @@ type DarknetDConfig struct {
 	darknetDataFile      string
 	modelConfigFile      string
 	modelWeightsFile     string
+	modelsFile           string
+	models               []Model
+	loadedModels         []Model // models as loaded, before any switch
+	modelsParallel       bool
+	pickup               string
+	backlog              string
+	ingestMaxBytes       int64
+	ingestRate           float64
+	motionThreshold      float64
+	motionHeartbeat      time.Duration
+	motionMask           string
+	darknetFlavor        string
+	historyFile          string
+	historyRetention     time.Duration
+	webhooksFile         string
+	mqtt                 mqttConfig
+	zonesFile            string
+	trackIoU             float64
+	trackMaxAge          time.Duration
+	linesFile            string
+	camerasFile          string
+	cameras              []CameraConfig
+	zones                []Zone
+	lines                []Line
+	webhooks             []*WebhookRule
+	configFile           string
+	configCheck          bool
+	argv                 []string // command line, re-read on reload
 }
 
 type DarknetJobResult struct {
@@ -45,23 +93,62 @@ type DarknetJobStatus int
 const (
 	DARKNET_STOPPED DarknetJobStatus = iota
 	DARKNET_RUNNING
+	DARKNET_STARTING
+	DARKNET_RESTARTING
 )
 
+func (s DarknetJobStatus) String() string {
+	switch s {
+	case DARKNET_STOPPED:
+		return "stopped"
+	case DARKNET_RUNNING:
+		return "running"
+	case DARKNET_STARTING:
+		return "starting"
+	case DARKNET_RESTARTING:
+		return "restarting"
+	}
+	return "unknown"
+}
+
+// DarknetState is the supervisor's view of the darknet process, as reported by /status.
+type DarknetState struct {
+	Status    string
+	Restarts  int
+	StartTime time.Time
+	LastError string
+	Model     string `json:",omitempty"`
+
+	status DarknetJobStatus
+}
+
 type DarknetResult struct {
-	Image      string
-	PredImage  string
-	ImageTime  time.Time
-	PredTime   time.Time
-	TimeDetect float64
-	TimeTotal  float64
-	Objects    []Object
+	ID            uint64
+	Camera        string `json:",omitempty"`
+	Model         string `json:",omitempty"`
+	Image         string
+	PredImage     string
+	ImageTime     time.Time
+	PredTime      time.Time
+	TimeDetect    float64
+	TimeTotal     float64
+	ModelTimes    map[string]float64 `json:",omitempty"`
+	Objects       []Object
+	ZoneCounts    map[string]int `json:",omitempty"`
+	ZoneEvents    []ZoneEvent    `json:",omitempty"`
+	TrackEvents   []TrackEvent   `json:",omitempty"`
+	LineCrossings []LineCrossing `json:",omitempty"`
 }
 
 type Object struct {
-	Class string
-	Prob  int
-	Left  int
-	Right int
-	Top   int
-	Bot   int
+	Class   string
+	Prob    int
+	Left    int
+	Right   int
+	Top     int
+	Bot     int
+	Zones   []string `json:",omitempty"`
+	TrackID uint64   `json:",omitempty"`
+	Dwell   float64  `json:",omitempty"`
+	Model   string   `json:",omitempty"`
 }
@@ -14,49 +14,223 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func getConfig() (DarknetDConfig, error) {
+// getConfig parses the command line argv, without the program name, and the
+// config file it names.
+func getConfig(argv []string) (DarknetDConfig, error) {
 	c := DarknetDConfig{}
-	args, err := docopt.Parse(usage, nil, true, version, false)
+	args, err := docopt.Parse(usage, argv, true, version, false)
 	if err != nil {
 		return c, fmt.Errorf("Error parsing args: %s", err.Error())
 	}
+	c.argv = argv
+	c.configCheck = args["check"].(bool)
+	c.configFile = args["--config"].(string)
+	sections := map[string][]byte{}
+	if c.configFile != "" {
+		if sections, err = loadConfigFile(c.configFile, args, argv); err != nil {
+			return c, err
+		}
+	}
 	c.capDir = args["--capture-dir"].(string)
 	c.capFile = args["--capture-file"].(string)
+	c.capURL = args["--capture-url"].(string)
+	intervalMsec, err := strconv.Atoi(args["--capture-interval"].(string))
+	if err != nil || intervalMsec <= 0 {
+		return c, fmt.Errorf("Invalid --capture-interval: %s", args["--capture-interval"].(string))
+	}
+	c.captureInterval = time.Duration(intervalMsec) * time.Millisecond
 	c.listenAddr = args["--listen-addr"].(string)
 	c.archiveDir = args["--archive-dir"].(string)
 	c.archiveFiles, err = strconv.Atoi(args["--archive-files"].(string))
 	if err != nil {
 		return c, fmt.Errorf("Invalid --archive-files: %s", err.Error())
 	}
+	if c.archiveFiles < 1 {
+		return c, fmt.Errorf("Invalid --archive-files: must be at least 1")
+	}
 	timeoutMsec, err := strconv.Atoi(args["--start-timeout"].(string))
 	if err != nil {
-		return c, fmt.Errorf("Invalid --detect-timeout: %s", err.Error())
+		return c, fmt.Errorf("Invalid --start-timeout: %s", err.Error())
+	}
+	if timeoutMsec <= 0 {
+		return c, fmt.Errorf("Invalid --start-timeout: must be greater than 0")
 	}
 	c.darknetStartTimeout = time.Duration(timeoutMsec) * time.Millisecond
 	timeoutMsec, err = strconv.Atoi(args["--detect-timeout"].(string))
 	if err != nil {
 		return c, fmt.Errorf("Invalid --detect-timeout: %s", err.Error())
 	}
+	if timeoutMsec <= 0 {
+		return c, fmt.Errorf("Invalid --detect-timeout: must be greater than 0")
+	}
 	c.darknetDetectTimeout = time.Duration(timeoutMsec) * time.Millisecond
 	delayMsec, err := strconv.Atoi(args["--detect-delay"].(string))
 	if err != nil {
 		return c, fmt.Errorf("Invalid --detect-delay: %s", err.Error())
 	}
+	if delayMsec < 0 {
+		return c, fmt.Errorf("Invalid --detect-delay: must not be negative")
+	}
 	c.darknetDetectDelay = time.Duration(delayMsec) * time.Millisecond
 	c.darknetDir = args["--darknet-dir"].(string)
 	c.darknetDataFile = args["--darknet-data"].(string)
 	c.modelConfigFile = args["--model-config"].(string)
 	c.modelWeightsFile = args["--model-weights"].(string)
+	c.modelsFile = args["--models-file"].(string)
+	if c.modelsFile != "" {
+		if c.models, err = loadModels(c.modelsFile); err != nil {
+			return c, fmt.Errorf("Error loading models: %s", err)
+		}
+	} else if data, ok := sections["models"]; ok {
+		if c.models, err = decodeModels(data, c.configFile+" models"); err != nil {
+			return c, err
+		}
+	}
+	for i := range c.models {
+		if c.models[i].Data == "" {
+			c.models[i].Data = c.darknetDataFile
+		}
+		if c.models[i].Config == "" {
+			c.models[i].Config = c.modelConfigFile
+		}
+	}
+	c.modelsParallel = args["--models-parallel"].(bool)
+	c.pickup = args["--pickup"].(string)
+	if c.pickup != "watch" && c.pickup != "poll" {
+		return c, fmt.Errorf("Invalid --pickup: %s", c.pickup)
+	}
+	c.ingestMaxBytes, err = strconv.ParseInt(args["--ingest-max-bytes"].(string), 10, 64)
+	if err != nil || c.ingestMaxBytes <= 0 {
+		return c, fmt.Errorf("Invalid --ingest-max-bytes: %s", args["--ingest-max-bytes"].(string))
+	}
+	c.ingestRate, err = strconv.ParseFloat(args["--ingest-rate"].(string), 64)
+	if err != nil || c.ingestRate < 0 {
+		return c, fmt.Errorf("Invalid --ingest-rate: %s", args["--ingest-rate"].(string))
+	}
+	c.motionThreshold, err = strconv.ParseFloat(args["--motion-threshold"].(string), 64)
+	if err != nil || c.motionThreshold < 0 || c.motionThreshold > 1 {
+		return c, fmt.Errorf("Invalid --motion-threshold: %s", args["--motion-threshold"].(string))
+	}
+	heartbeatMsec, err := strconv.Atoi(args["--motion-heartbeat"].(string))
+	if err != nil || heartbeatMsec < 0 {
+		return c, fmt.Errorf("Invalid --motion-heartbeat: %s", args["--motion-heartbeat"].(string))
+	}
+	c.motionHeartbeat = time.Duration(heartbeatMsec) * time.Millisecond
+	c.motionMask = args["--motion-mask"].(string)
+	c.backlog = args["--backlog"].(string)
+	if _, err := parseBacklog(c.backlog); err != nil {
+		return c, fmt.Errorf("Invalid --backlog: %s %s", c.backlog, err)
+	}
+	c.historyFile = args["--history-file"].(string)
+	historyDays, err := strconv.Atoi(args["--history-days"].(string))
+	if err != nil || historyDays < 1 {
+		return c, fmt.Errorf("Invalid --history-days: %s", args["--history-days"].(string))
+	}
+	c.historyRetention = time.Duration(historyDays) * time.Hour * 24
+	c.trackIoU, err = strconv.ParseFloat(args["--track-iou"].(string), 64)
+	if err != nil || c.trackIoU < 0 || c.trackIoU > 1 {
+		return c, fmt.Errorf("Invalid --track-iou: %s", args["--track-iou"].(string))
+	}
+	maxAgeMsec, err := strconv.Atoi(args["--track-max-age"].(string))
+	if err != nil || maxAgeMsec <= 0 {
+		return c, fmt.Errorf("Invalid --track-max-age: %s", args["--track-max-age"].(string))
+	}
+	c.trackMaxAge = time.Duration(maxAgeMsec) * time.Millisecond
+	c.linesFile = args["--lines-file"].(string)
+	if c.linesFile != "" {
+		if c.lines, err = loadLines(c.linesFile); err != nil {
+			return c, fmt.Errorf("Error loading lines: %s", err)
+		}
+	} else if data, ok := sections["lines"]; ok {
+		if c.lines, err = decodeLines(data, c.configFile+" lines"); err != nil {
+			return c, err
+		}
+	}
+	c.zonesFile = args["--zones-file"].(string)
+	if c.zonesFile != "" {
+		if c.zones, err = loadZones(c.zonesFile); err != nil {
+			return c, fmt.Errorf("Error loading zones: %s", err)
+		}
+	} else if data, ok := sections["zones"]; ok {
+		if c.zones, err = decodeZones(data, c.configFile+" zones"); err != nil {
+			return c, err
+		}
+	}
+	c.webhooksFile = args["--webhooks-file"].(string)
+	if c.webhooksFile != "" {
+		if c.webhooks, err = loadWebhookRules(c.webhooksFile); err != nil {
+			return c, fmt.Errorf("Error loading webhooks: %s", err)
+		}
+	} else if data, ok := sections["webhooks"]; ok {
+		if c.webhooks, err = decodeWebhookRules(data, c.configFile+" webhooks"); err != nil {
+			return c, err
+		}
+	}
+	c.camerasFile = args["--cameras-file"].(string)
+	if c.camerasFile != "" {
+		if c.cameras, err = loadCameras(c.camerasFile); err != nil {
+			return c, fmt.Errorf("Error loading cameras: %s", err)
+		}
+	} else if data, ok := sections["cameras"]; ok {
+		if c.cameras, err = decodeCameras(data, c.configFile+" cameras"); err != nil {
+			return c, err
+		}
+	} else {
+		c.cameras = []CameraConfig{{
+			Name:         defaultCamera,
+			CaptureDir:   c.capDir,
+			CaptureFile:  c.capFile,
+			ArchiveDir:   c.archiveDir,
+			URL:          c.capURL,
+			MotionMask:   c.motionMask,
+			ArchiveFiles: c.archiveFiles,
+		}}
+	}
+	if err := validateCameras(c.cameras, c); err != nil {
+		return c, err
+	}
+	c.mqtt.broker = args["--mqtt-broker"].(string)
+	c.mqtt.username = args["--mqtt-username"].(string)
+	c.mqtt.password = args["--mqtt-password"].(string)
+	c.mqtt.prefix = strings.TrimSuffix(args["--mqtt-topic"].(string), "/")
+	c.mqtt.discoveryPrefix = strings.TrimSuffix(args["--mqtt-discovery"].(string), "/")
+	c.mqtt.retain = args["--mqtt-retain"].(bool)
+	qos, err := strconv.Atoi(args["--mqtt-qos"].(string))
+	if err != nil || qos < 0 || qos > 2 {
+		return c, fmt.Errorf("Invalid --mqtt-qos: %s", args["--mqtt-qos"].(string))
+	}
+	c.mqtt.qos = byte(qos)
+	if c.mqtt.prefix == "" {
+		return c, fmt.Errorf("Invalid --mqtt-topic: must not be empty")
+	}
+	c.darknetFlavor = args["--darknet-flavor"].(string)
+	if _, ok := darknetFlavors[c.darknetFlavor]; !ok && c.darknetFlavor != "auto" {
+		return c, fmt.Errorf("Invalid --darknet-flavor: %s", c.darknetFlavor)
+	}
+	if err := validatePaths(c); err != nil {
+		return c, err
+	}
+	if len(c.models) == 0 {
+		c.models = []Model{flagModel(c)}
+	}
+	c.loadedModels = c.models
 	return c, nil
 }
 
-func startArchiveManager(archiveDir string, archiveFiles int, cleanedUpFiles prometheus.Counter, cleanUpErrors *prometheus.CounterVec) error {
+// startArchiveManager keeps the newest archiveFiles() images in archiveDir,
+// checking every interval until quit is closed, and calls removed with the
+// name of each image it removes. archiveFiles is called on every cleanup, so
+// reloaded settings apply.
+func startArchiveManager(archiveDir string, interval time.Duration, archiveFiles func() int, removed func(name string), cleanedUpFiles prometheus.Counter, cleanUpErrors *prometheus.CounterVec, quit <-chan struct{}) error {
 	go func() {
-		cleanTick := time.NewTicker(time.Millisecond * 10000)
+		cleanTick := time.NewTicker(interval)
 		defer cleanTick.Stop()
 		for {
 			select {
+			case <-quit:
+				return
 			case <-cleanTick.C:
+				archiveFiles := archiveFiles()
 				files, err := ioutil.ReadDir(archiveDir)
 				if err != nil {
 					cleanUpErrors.WithLabelValues("ReadDir").Add(1)
@@ -64,7 +238,7 @@ func startArchiveManager(archiveDir string, archiveFiles int, cleanedUpFiles pro
 					break
 				}
 				if len(files) > archiveFiles {
-					if err := cleanupFiles(archiveDir, len(files)-archiveFiles, files); err != nil {
+					if err := cleanupFiles(archiveDir, len(files)-archiveFiles, files, removed); err != nil {
 						log.Printf("Cleanup error: %s", err)
 						cleanUpErrors.WithLabelValues("cleanupFiles").Add(1)
 					} else {
@@ -77,7 +251,7 @@ func startArchiveManager(archiveDir string, archiveFiles int, cleanedUpFiles pro
 	return nil
 }
 
-func cleanupFiles(archiveDir string, numToCleanup int, files []os.FileInfo) error {
+func cleanupFiles(archiveDir string, numToCleanup int, files []os.FileInfo, removed func(name string)) error {
 	fs := map[string]os.FileInfo{}
 	for _, f := range files {
 		fs[f.Name()] = f
@@ -88,6 +262,7 @@ func cleanupFiles(archiveDir string, numToCleanup int, files []os.FileInfo) erro
 			return err
 		}
 		delete(fs, oldest.Name())
+		removed(oldest.Name())
 	}
 	return nil
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestArchiveManager(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for n := 1; n <= 6; n++ {
+		path := filepath.Join(dir, fmt.Sprintf("image%d.jpg", n))
+		writeFile(t, path, fakeJPEG(path))
+		mtime := now.Add(time.Duration(n-6) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mtx sync.Mutex
+	removed := []string{}
+	cleanedUp := prometheus.NewCounter(prometheus.CounterOpts{Name: "cleaned_up"})
+	errors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors"}, []string{"type"})
+	quit := make(chan struct{})
+	defer close(quit)
+	err := startArchiveManager(dir, 20*time.Millisecond, func() int { return 4 }, func(name string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		removed = append(removed, name)
+	}, cleanedUp, errors, quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the archive to be cleaned up", func() bool { return testutil.ToFloat64(cleanedUp) == 2 })
+	mtx.Lock()
+	sort.Strings(removed)
+	if !reflect.DeepEqual(removed, []string{"image1.jpg", "image2.jpg"}) {
+		t.Errorf("Removed %v", removed)
+	}
+	mtx.Unlock()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := []string{}
+	for _, f := range files {
+		left = append(left, f.Name())
+	}
+	if !reflect.DeepEqual(left, []string{"image3.jpg", "image4.jpg", "image5.jpg", "image6.jpg"}) {
+		t.Errorf("Left %v in the archive", left)
+	}
+	if n := testutil.CollectAndCount(errors); n != 0 {
+		t.Errorf("%d cleanup errors", n)
+	}
+}
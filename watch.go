@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// imageWatcher watches an archive directory for new images and passes each
+// on once the capture tool has finished writing it: when it has had no
+// events for watchSettleTime and is a complete JPEG. Images renamed into the
+// directory arrive complete; images written in place are checked until they
+// are, or skipped after watchMaxWriteTime.
+type imageWatcher struct {
+	dir     string
+	watcher *fsnotify.Watcher
+	pending map[string]pendingImage
+	ready   func(name string)
+	errors  *prometheus.CounterVec
+}
+
+type pendingImage struct {
+	first time.Time // first event
+	last  time.Time // latest event
+}
+
+// watchImages starts watching dir, calling ready with the name of each new
+// image, oldest first, starting with the newest image already there.
+func watchImages(dir string, ready func(name string), errors *prometheus.CounterVec) (*imageWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	iw := &imageWatcher{
+		dir:     dir,
+		watcher: watcher,
+		pending: map[string]pendingImage{},
+		ready:   ready,
+		errors:  errors,
+	}
+	iw.rescan()
+	go iw.run()
+	return iw, nil
+}
+
+// close stops watching.
+func (iw *imageWatcher) close() {
+	iw.watcher.Close()
+}
+
+func (iw *imageWatcher) run() {
+	tick := time.NewTicker(watchSettleTime / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case ev, ok := <-iw.watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Base(ev.Name)
+			if !isArchiveImage(name) {
+				continue
+			}
+			switch {
+			case ev.Has(fsnotify.Create), ev.Has(fsnotify.Write):
+				now := time.Now()
+				p, ok := iw.pending[name]
+				if !ok {
+					p.first = now
+				}
+				p.last = now
+				iw.pending[name] = p
+			case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+				delete(iw.pending, name)
+			}
+		case err, ok := <-iw.watcher.Errors:
+			if !ok {
+				return
+			}
+			// events may have been lost, e.g. on queue overflow
+			log.Printf("Error watching %s, rescanning: %s", iw.dir, err)
+			iw.errors.WithLabelValues("watch").Add(1)
+			iw.rescan()
+		case now := <-tick.C:
+			iw.settle(now)
+		}
+	}
+}
+
+// rescan adds the newest image in the directory, if any, to the pending ones.
+func (iw *imageWatcher) rescan() {
+	f, err := findNewest(iw.dir)
+	if err != nil || !isArchiveImage(f.Name()) {
+		return
+	}
+	if _, ok := iw.pending[f.Name()]; !ok {
+		iw.pending[f.Name()] = pendingImage{first: time.Now()}
+	}
+}
+
+// settle passes on the pending images that are complete.
+func (iw *imageWatcher) settle(now time.Time) {
+	ready := []string{}
+	for name, p := range iw.pending {
+		if now.Sub(p.last) < watchSettleTime {
+			continue
+		}
+		complete, err := jpegComplete(filepath.Join(iw.dir, name))
+		if err != nil {
+			delete(iw.pending, name) // removed, e.g. by archive cleanup
+			continue
+		}
+		if !complete {
+			if now.Sub(p.first) > watchMaxWriteTime {
+				log.Printf("Skipping incomplete image %s", filepath.Join(iw.dir, name))
+				iw.errors.WithLabelValues("incomplete").Add(1)
+				delete(iw.pending, name)
+			}
+			continue
+		}
+		ready = append(ready, name)
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		pi, pj := iw.pending[ready[i]], iw.pending[ready[j]]
+		if !pi.first.Equal(pj.first) {
+			return pi.first.Before(pj.first)
+		}
+		return ready[i] < ready[j]
+	})
+	for _, name := range ready {
+		delete(iw.pending, name)
+		iw.ready(name)
+	}
+}
+
+// isArchiveImage reports whether name is a captured image, rather than a
+// prediction image or a temporary file.
+func isArchiveImage(name string) bool {
+	return strings.HasSuffix(name, ".jpg") && !strings.HasPrefix(name, "predictions_") && !strings.HasPrefix(name, ".")
+}
+
+// jpegComplete reports whether the file at path starts with a JPEG SOI marker
+// and ends with an EOI marker, ignoring zero padding after it.
+func jpegComplete(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false, nil
+	}
+	if !bytes.Equal(head, []byte{0xff, 0xd8}) {
+		return false, nil
+	}
+	tailSize := int64(1024)
+	if fi.Size() < tailSize {
+		tailSize = fi.Size()
+	}
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, fi.Size()-tailSize); err != nil {
+		return false, fmt.Errorf("Error reading %s: %s", path, err)
+	}
+	return bytes.HasSuffix(bytes.TrimRight(tail, "\x00"), []byte{0xff, 0xd9}), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	td := startTestDaemon(t, newTestDir(t), "--pickup=watch")
+	if td.cameras[0].watcher == nil {
+		t.Fatalf("Archive not watched")
+	}
+	archive := filepath.Join(td.dir, "archive")
+
+	td.capture("image1.jpg")
+	td.waitForImage("/objects", "image1.jpg")
+	time.Sleep(300 * time.Millisecond)
+	if n := td.detections("default", "yolov3-tiny"); n != 1 {
+		t.Errorf("image1.jpg detected %d times", n)
+	}
+
+	writeFile(t, filepath.Join(archive, "image2.jpg"), "\xff\xd8\xff\xe0half written")
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := findImage(td.objects(""), "image2.jpg"); ok {
+		t.Errorf("Half-written image2.jpg detected")
+	}
+	f, err := os.OpenFile(filepath.Join(archive, "image2.jpg"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("\xff\xd9"))
+	f.Close()
+	td.waitForImage("/objects", "image2.jpg")
+
+	td.capture("image3.jpg~")
+	if err := os.Rename(filepath.Join(archive, "image3.jpg~"), filepath.Join(archive, "image3.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	td.waitForImage("/objects", "image3.jpg")
+	if n := td.detections("default", "yolov3-tiny"); n != 3 {
+		t.Errorf("Expected 3 detections, got %d", n)
+	}
+}
+
+func TestWatchDetectDelay(t *testing.T) {
+	td := startTestDaemon(t, newTestDir(t), "--pickup=watch", "--backlog=all", "--detect-delay=300")
+	for _, name := range []string{"image1.jpg", "image2.jpg", "image3.jpg"} {
+		td.capture(name)
+	}
+	td.waitForImage("/objects", "image3.jpg")
+	results := td.objects("")
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 detections, got %+v", results)
+	}
+	for i := 1; i < len(results); i++ {
+		if d := results[i].PredTime.Sub(results[i-1].PredTime); d < 300*time.Millisecond {
+			t.Errorf("Detections %d and %d only %s apart", i-1, i, d)
+		}
+	}
+}
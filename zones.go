@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Zone is a named polygon in the frame. Points are pixels, or fractions of the
+// frame size when Normalized. Objects are assigned to a zone by their bbox
+// Anchor: "bottom" (center of the bottom edge, where people and cars touch
+// the ground) or "center".
+type Zone struct {
+	Name       string
+	Points     [][2]float64
+	Normalized bool
+	Anchor     string
+}
+
+// ZoneEvent reports a class entering (first object appears) or leaving (last
+// object disappears) a zone.
+type ZoneEvent struct {
+	Zone  string
+	Class string
+	Event string
+	Count int
+}
+
+// Zones assigns objects to zones and tracks per-zone occupancy.
+type Zones struct {
+	zones      []Zone
+	archiveDir string
+	counts     map[string]map[string]int // zone -> class -> objects
+	mtx        sync.Mutex
+
+	occupancy *prometheus.GaugeVec
+	events    *prometheus.CounterVec
+}
+
+// loadZones reads a JSON array of Zone from path.
+func loadZones(path string) ([]Zone, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeZones(data, path)
+}
+
+// decodeZones decodes a JSON array of Zone, read from source.
+func decodeZones(data []byte, source string) ([]Zone, error) {
+	zones := []Zone{}
+	if err := json.Unmarshal(data, &zones); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", source, err)
+	}
+	if err := validateZones(zones); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+func validateZones(zones []Zone) error {
+	names := map[string]bool{}
+	for i, z := range zones {
+		if z.Name == "" {
+			return fmt.Errorf("Invalid zone %d: Name is required", i)
+		}
+		if names[z.Name] {
+			return fmt.Errorf("Invalid zone %s: duplicate Name", z.Name)
+		}
+		names[z.Name] = true
+		if len(z.Points) < 3 {
+			return fmt.Errorf("Invalid zone %s: at least 3 Points are required", z.Name)
+		}
+		switch z.Anchor {
+		case "", "bottom", "center":
+		default:
+			return fmt.Errorf("Invalid zone %s: Anchor must be bottom or center", z.Name)
+		}
+		if z.Normalized {
+			for _, p := range z.Points {
+				if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+					return fmt.Errorf("Invalid zone %s: normalized Points must be between 0 and 1", z.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func newZones(zones []Zone, archiveDir string, occupancy *prometheus.GaugeVec, events *prometheus.CounterVec) *Zones {
+	return &Zones{
+		zones:      zones,
+		archiveDir: archiveDir,
+		counts:     map[string]map[string]int{},
+		occupancy:  occupancy,
+		events:     events,
+	}
+}
+
+// set replaces the zones, e.g. on reload. Occupancy of zones that are kept
+// carries over, so enter/leave events continue where they left off.
+func (zs *Zones) set(zones []Zone) {
+	zs.mtx.Lock()
+	defer zs.mtx.Unlock()
+	kept := map[string]bool{}
+	for _, z := range zones {
+		kept[z.Name] = true
+	}
+	for _, z := range zs.zones {
+		if !kept[z.Name] {
+			zs.occupancy.DeletePartialMatch(prometheus.Labels{"zone": z.Name})
+			delete(zs.counts, z.Name)
+		}
+	}
+	zs.zones = zones
+}
+
+// apply sets Zones on each object in lr, fills in lr.ZoneCounts, and adds
+// enter/leave events for classes whose occupancy changed to or from zero.
+func (zs *Zones) apply(lr *DarknetResult) {
+	zs.mtx.Lock()
+	zones := zs.zones
+	zs.mtx.Unlock()
+	if len(zones) == 0 {
+		return
+	}
+	width, height := 0.0, 0.0
+	for _, z := range zones {
+		if z.Normalized {
+			b := imageBounds(filepath.Join(zs.archiveDir, lr.Image))
+			width, height = float64(b.Dx()), float64(b.Dy())
+			break
+		}
+	}
+
+	counts := map[string]map[string]int{}
+	for _, z := range zones {
+		counts[z.Name] = map[string]int{}
+		if z.Normalized && (width == 0 || height == 0) {
+			log.Printf("Zone %s: unknown size of %s, skipping", z.Name, lr.Image)
+			continue
+		}
+		for i := range lr.Objects {
+			x, y := anchorPoint(lr.Objects[i], z.Anchor)
+			if z.Normalized {
+				x, y = x/width, y/height
+			}
+			if pointInPolygon(x, y, z.Points) {
+				lr.Objects[i].Zones = append(lr.Objects[i].Zones, z.Name)
+				counts[z.Name][lr.Objects[i].Class]++
+			}
+		}
+	}
+
+	zs.mtx.Lock()
+	defer zs.mtx.Unlock()
+	lr.ZoneCounts = map[string]int{}
+	for _, z := range zones {
+		total := 0
+		for _, n := range counts[z.Name] {
+			total += n
+		}
+		lr.ZoneCounts[z.Name] = total
+
+		classes := map[string]bool{}
+		for class := range counts[z.Name] {
+			classes[class] = true
+		}
+		for class := range zs.counts[z.Name] {
+			classes[class] = true
+		}
+		sorted := []string{}
+		for class := range classes {
+			sorted = append(sorted, class)
+		}
+		sort.Strings(sorted)
+		for _, class := range sorted {
+			last, now := zs.counts[z.Name][class], counts[z.Name][class]
+			zs.occupancy.WithLabelValues(z.Name, class).Set(float64(now))
+			event := ""
+			if last == 0 && now > 0 {
+				event = "enter"
+			} else if last > 0 && now == 0 {
+				event = "leave"
+			}
+			if event != "" {
+				lr.ZoneEvents = append(lr.ZoneEvents, ZoneEvent{Zone: z.Name, Class: class, Event: event, Count: now})
+				zs.events.WithLabelValues(z.Name, class, event).Add(1)
+			}
+		}
+	}
+	zs.counts = counts
+}
+
+func anchorPoint(o Object, anchor string) (float64, float64) {
+	x := float64(o.Left+o.Right) / 2
+	if anchor == "center" {
+		return x, float64(o.Top+o.Bot) / 2
+	}
+	return x, float64(o.Bot)
+}
+
+// pointInPolygon uses ray casting; points on an edge may fall either side.
+func pointInPolygon(x, y float64, poly [][2]float64) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		xi, yi := poly[i][0], poly[i][1]
+		xj, yj := poly[j][0], poly[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// doorZone covers the nnpack fixture's person, but not its dog.
+const doorZone = `[{"Name": "door", "Points": [[300, 300], [500, 300], [500, 450], [300, 450]]}]`
+
+// hasZoneEvent reports whether results hold a zone event.
+func hasZoneEvent(results []DarknetResult, zone, class, event string) bool {
+	for _, lr := range results {
+		for _, ze := range lr.ZoneEvents {
+			if ze.Zone == zone && ze.Class == class && ze.Event == event {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestZones(t *testing.T) {
+	t.Setenv("FAKEDARKNET_FIXTURE", fixture("nnpack"))
+	dir := newTestDir(t)
+	writeFile(t, filepath.Join(dir, "zones.json"), doorZone)
+	td := startTestDaemon(t, dir, "--zones-file=DIR/zones.json")
+	td.timelapse()
+
+	waitFor(t, "a person to leave the door zone", func() bool {
+		return hasZoneEvent(td.objects(""), "door", "person", "leave")
+	})
+	results := td.objects("?zone=door")
+	if len(results) == 0 {
+		t.Fatalf("/objects?zone=door returned nothing")
+	}
+	for _, lr := range results {
+		for _, o := range lr.Objects {
+			if o.Class != "person" || !reflect.DeepEqual(o.Zones, []string{"door"}) {
+				t.Errorf("/objects?zone=door returned %+v", o)
+			}
+		}
+	}
+	if n := testutil.ToFloat64(td.metrics.ZoneEvents.WithLabelValues("default", "door", "person", "enter")); n < 1 {
+		t.Errorf("Zone enter events not counted")
+	}
+}